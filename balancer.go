@@ -0,0 +1,393 @@
+package webpipes
+
+import "errors"
+import "hash/fnv"
+import "io"
+import "log"
+import "net/http"
+import "net/url"
+import "sync"
+import "sync/atomic"
+import "time"
+
+//////////////////////////////////////////////////////////////////////////////
+// Load balancing
+//
+// A Balancer proxies requests to one of several equivalent backends, chosen
+// by a Strategy from those that are currently usable. A backend stops being
+// usable when an active health check fails, until a later check passes, or
+// when it fails too many requests in a row, in which case it is ejected for
+// a while. Requests with idempotent methods and no body are retried on
+// another backend if the first cannot be reached or reports that it is
+// unavailable.
+
+// A backend server, and what is known about its state
+type Backend struct {
+	URL *url.URL
+
+	active int64
+
+	mu           sync.Mutex
+	healthy      bool
+	fails        int
+	ejectedUntil time.Time
+}
+
+// Return the number of requests the backend is currently handling
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// Report whether the backend may be sent requests
+func (b *Backend) Usable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy && !time.Now().Before(b.ejectedUntil)
+}
+
+// Chooses a backend for a request from a non-empty list of usable backends
+type Strategy func(backends []*Backend, req *http.Request) *Backend
+
+// Choose each backend in turn
+func RoundRobin() Strategy {
+	var next uint64
+	return func(backends []*Backend, req *http.Request) *Backend {
+		n := atomic.AddUint64(&next, 1) - 1
+		return backends[n%uint64(len(backends))]
+	}
+}
+
+// Choose the backend handling the fewest requests, taking them in turn when
+// several are equally busy
+func LeastConnections() Strategy {
+	var next uint64
+	return func(backends []*Backend, req *http.Request) *Backend {
+		start := int(atomic.AddUint64(&next, 1) % uint64(len(backends)))
+		var best *Backend
+		for i := range backends {
+			backend := backends[(start+i)%len(backends)]
+			if best == nil || backend.Active() < best.Active() {
+				best = backend
+			}
+		}
+		return best
+	}
+}
+
+// Choose a backend by hashing the value returned by 'key', so that requests
+// with the same value go to the same backend for as long as it is usable.
+// When a backend becomes unusable only the values that went to it move
+// elsewhere. Requests for which 'key' returns the empty string are spread
+// round-robin.
+func ConsistentHash(key func(*http.Request) string) Strategy {
+	fallback := RoundRobin()
+	return func(backends []*Backend, req *http.Request) *Backend {
+		value := key(req)
+		if value == "" {
+			return fallback(backends, req)
+		}
+
+		// Rendezvous hashing: the backend with the highest score wins
+		var best *Backend
+		var bestScore uint64
+		for _, backend := range backends {
+			h := fnv.New64a()
+			io.WriteString(h, value)
+			h.Write([]byte{0})
+			io.WriteString(h, backend.URL.String())
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = backend, score
+			}
+		}
+		return best
+	}
+}
+
+// Hash on the value of the request header 'name'
+func HashHeader(name string) Strategy {
+	return ConsistentHash(func(req *http.Request) string {
+		return req.Header.Get(name)
+	})
+}
+
+// Hash on the value of the cookie 'name'
+func HashCookie(name string) Strategy {
+	return ConsistentHash(func(req *http.Request) string {
+		if cookie, err := req.Cookie(name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	})
+}
+
+// Hash on the path of the request
+func HashPath() Strategy {
+	return ConsistentHash(func(req *http.Request) string {
+		return req.URL.Path
+	})
+}
+
+// Options for a balancer
+type BalancerOptions struct {
+	// How to choose between the usable backends, RoundRobin if nil
+	Strategy Strategy
+
+	// If not empty, each backend is sent a GET for this path every
+	// HealthInterval (10 seconds if zero), and is unusable until it
+	// answers with a 2xx or 3xx status within HealthTimeout (2 seconds if
+	// zero)
+	HealthPath     string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	// If not zero, a backend that fails this many requests in a row is
+	// ejected for EjectFor (30 seconds if zero). Failures are errors
+	// reaching the backend and 5xx responses.
+	MaxFails int
+	EjectFor time.Duration
+
+	// How many other backends to try when a request with an idempotent
+	// method and no body cannot be completed
+	Retries int
+
+	// The transport and timeout used for the requests. The Select function
+	// is not used.
+	Proxy ProxyOptions
+}
+
+// Returned when there is no backend that can be sent a request
+var ErrNoBackend = errors.New("webpipes: no backend available")
+
+// Spreads requests over several backends
+type Balancer struct {
+	backends []*Backend
+	opts     BalancerOptions
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// Create a balancer for the backends at 'targets'. If health checks are
+// configured they start straight away, and are stopped by Close.
+func NewBalancer(targets []*url.URL, opts BalancerOptions) *Balancer {
+	if opts.Strategy == nil {
+		opts.Strategy = RoundRobin()
+	}
+	if opts.HealthInterval == 0 {
+		opts.HealthInterval = 10 * time.Second
+	}
+	if opts.HealthTimeout == 0 {
+		opts.HealthTimeout = 2 * time.Second
+	}
+	if opts.EjectFor == 0 {
+		opts.EjectFor = 30 * time.Second
+	}
+
+	b := &Balancer{opts: opts, stop: make(chan struct{})}
+	for _, target := range targets {
+		b.backends = append(b.backends, &Backend{URL: target, healthy: true})
+	}
+	if opts.HealthPath != "" {
+		go b.healthLoop()
+	}
+	return b
+}
+
+// Return the backends of the balancer
+func (b *Balancer) Backends() []*Backend {
+	return b.backends
+}
+
+// Stop the health checks
+func (b *Balancer) Close() {
+	b.once.Do(func() {
+		close(b.stop)
+	})
+}
+
+// Return a source that proxies each request to a backend. If no backend is
+// usable the request is answered with a 503. A 502, 503 or 504 from a backend
+// is passed on when there is no other backend left to try, and otherwise
+// failures are answered as they are by NewProxySource.
+func (b *Balancer) Source() Source {
+	return func(conn *Conn, req *http.Request, writer io.WriteCloser) bool {
+		attempts := 1
+		if idempotent(req.Method) && req.ContentLength == 0 {
+			attempts += b.opts.Retries
+		}
+
+		tried := make(map[*Backend]bool)
+		err := ErrNoBackend
+
+		// A response saying the backend was unavailable, which is passed on
+		// if no other backend does any better
+		var unavailable *http.Response
+		defer func() {
+			if unavailable != nil {
+				unavailable.Body.Close()
+			}
+		}()
+
+		for i := 0; i < attempts && conn.Context().Err() == nil; i++ {
+			backend := b.choose(req, tried)
+			if backend == nil {
+				break
+			}
+			tried[backend] = true
+
+			atomic.AddInt64(&backend.active, 1)
+			resp, rerr := proxyRoundTrip(conn, req, backend.URL, req.Body, &b.opts.Proxy)
+			if rerr != nil {
+				err = rerr
+				atomic.AddInt64(&backend.active, -1)
+				b.failed(backend)
+				continue
+			}
+			resp.Body = &cancelBody{resp.Body, func() {
+				atomic.AddInt64(&backend.active, -1)
+			}}
+
+			if resp.StatusCode >= 500 {
+				b.failed(backend)
+			} else {
+				b.succeeded(backend)
+			}
+			if retryStatus(resp.StatusCode) && i+1 < attempts && b.usable(tried) != nil {
+				if unavailable != nil {
+					unavailable.Body.Close()
+				}
+				unavailable = resp
+				continue
+			}
+
+			proxyResponse(conn, resp, writer)
+			return true
+		}
+
+		if unavailable != nil {
+			proxyResponse(conn, unavailable, writer)
+			unavailable = nil
+			return true
+		}
+
+		writer.Close()
+		if err == ErrNoBackend {
+			log.Printf("webpipes: no backend for %s", req.URL)
+			conn.HTTPStatusResponse(http.StatusServiceUnavailable)
+		} else {
+			proxyError(conn, req, err)
+		}
+		return true
+	}
+}
+
+// Choose a usable backend that has not been tried yet, or return nil
+func (b *Balancer) choose(req *http.Request, tried map[*Backend]bool) *Backend {
+	usable := b.usable(tried)
+	if len(usable) == 0 {
+		return nil
+	}
+	return b.opts.Strategy(usable, req)
+}
+
+// Return the usable backends that have not been tried yet
+func (b *Balancer) usable(tried map[*Backend]bool) []*Backend {
+	var usable []*Backend
+	for _, backend := range b.backends {
+		if !tried[backend] && backend.Usable() {
+			usable = append(usable, backend)
+		}
+	}
+	return usable
+}
+
+// Record a failed request, ejecting the backend if it has failed too often
+func (b *Balancer) failed(backend *Backend) {
+	if b.opts.MaxFails <= 0 {
+		return
+	}
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	backend.fails++
+	if backend.fails >= b.opts.MaxFails {
+		log.Printf("webpipes: ejecting backend %s after %d failures", backend.URL, backend.fails)
+		backend.fails = 0
+		backend.ejectedUntil = time.Now().Add(b.opts.EjectFor)
+	}
+}
+
+// Record a successful request
+func (b *Balancer) succeeded(backend *Backend) {
+	backend.mu.Lock()
+	backend.fails = 0
+	backend.mu.Unlock()
+}
+
+// Check the health of every backend until the balancer is closed
+func (b *Balancer) healthLoop() {
+	client := &http.Client{
+		Transport: b.opts.Proxy.Transport,
+		Timeout:   b.opts.HealthTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ticker := time.NewTicker(b.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, backend := range b.backends {
+			wg.Add(1)
+			go func(backend *Backend) {
+				defer wg.Done()
+				b.checkHealth(client, backend)
+			}(backend)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Send a health check to 'backend' and record the result
+func (b *Balancer) checkHealth(client *http.Client, backend *Backend) {
+	check := *backend.URL
+	check.Path = singleJoiningSlash(backend.URL.Path, b.opts.HealthPath)
+	check.RawPath = ""
+
+	healthy := false
+	resp, err := client.Get(check.String())
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if healthy != backend.healthy {
+		log.Printf("webpipes: backend %s is now healthy: %v", backend.URL, healthy)
+	}
+	backend.healthy = healthy
+}
+
+// Report whether requests with 'method' may safely be repeated
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Report whether a response says the backend could not handle the request
+// right now, so that another backend should be tried
+func retryStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
@@ -0,0 +1,221 @@
+package webpipes
+
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// Start backends that answer with their index, or with the status returned
+// by 'status' if it is not zero
+func testBackends(t *testing.T, n int, status func(i int, req *http.Request) int) []*url.URL {
+	var targets []*url.URL
+	for i := 0; i < n; i++ {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if status != nil {
+				if code := status(i, req); code != 0 {
+					w.WriteHeader(code)
+					fmt.Fprintf(w, "%d:%d", i, code)
+					return
+				}
+			}
+			fmt.Fprint(w, i)
+		}))
+		t.Cleanup(srv.Close)
+		target, _ := url.Parse(srv.URL)
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Send a request through 'b', returning the status and body
+func balancedGet(t *testing.T, b *Balancer, header http.Header) (int, string) {
+	req := httptest.NewRequest("GET", "/", nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	Chain(b.Source(), OutputPipe).ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := NewBalancer(testBackends(t, 3, nil), BalancerOptions{})
+	defer b.Close()
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		_, body := balancedGet(t, b, nil)
+		got = append(got, body)
+	}
+	if strings.Join(got, ",") != "0,1,2,0,1,2" {
+		t.Errorf("backends %v", got)
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	release := make(chan bool)
+	var held int32
+	targets := testBackends(t, 2, func(i int, req *http.Request) int {
+		if req.URL.Path == "/hold" {
+			atomic.AddInt32(&held, 1)
+			<-release
+		}
+		return 0
+	})
+	b := NewBalancer(targets, BalancerOptions{Strategy: LeastConnections()})
+	defer b.Close()
+	source := Chain(b.Source(), OutputPipe)
+
+	// Hold a request open on one backend, and the rest go to the other
+	done := make(chan string)
+	go func() {
+		rec := httptest.NewRecorder()
+		source.ServeHTTP(rec, httptest.NewRequest("GET", "/hold", nil))
+		done <- rec.Body.String()
+	}()
+	for atomic.LoadInt32(&held) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		_, body := balancedGet(t, b, nil)
+		got = append(got, body)
+	}
+	close(release)
+	heldBy := <-done
+
+	for _, body := range got {
+		if body == heldBy {
+			t.Errorf("request sent to busy backend %s: %v", heldBy, got)
+			break
+		}
+	}
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	b := NewBalancer(testBackends(t, 4, nil), BalancerOptions{Strategy: HashHeader("X-User")})
+	defer b.Close()
+
+	users := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		user := fmt.Sprint("user", i)
+		_, body := balancedGet(t, b, http.Header{"X-User": {user}})
+		users[user] = body
+		if _, again := balancedGet(t, b, http.Header{"X-User": {user}}); again != body {
+			t.Errorf("%s sent to %s and then %s", user, body, again)
+		}
+	}
+
+	// Take a backend out, and only its users should move
+	removed := b.Backends()[1]
+	removed.mu.Lock()
+	removed.healthy = false
+	removed.mu.Unlock()
+	for user, before := range users {
+		_, after := balancedGet(t, b, http.Header{"X-User": {user}})
+		if after == "1" || (before != "1" && after != before) {
+			t.Errorf("%s moved from %s to %s", user, before, after)
+		}
+	}
+}
+
+func TestBalancerEjection(t *testing.T) {
+	targets := testBackends(t, 2, func(i int, req *http.Request) int {
+		if i == 0 {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+	b := NewBalancer(targets, BalancerOptions{MaxFails: 2, EjectFor: time.Minute})
+	defer b.Close()
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		_, body := balancedGet(t, b, nil)
+		got = append(got, body)
+	}
+	if strings.Join(got, ",") != "0:500,1,0:500,1,1,1" {
+		t.Errorf("responses %v", got)
+	}
+	if b.Backends()[0].Usable() {
+		t.Errorf("failing backend was not ejected")
+	}
+}
+
+func TestBalancerRetry(t *testing.T) {
+	targets := testBackends(t, 2, nil)
+	dead, _ := url.Parse("http://127.0.0.1:1")
+	b := NewBalancer(append([]*url.URL{dead}, targets...), BalancerOptions{Retries: 1})
+	defer b.Close()
+
+	// Requests that land on the dead backend are retried on the next
+	for i := 0; i < 6; i++ {
+		if code, body := balancedGet(t, b, nil); code != http.StatusOK {
+			t.Errorf("GET: status %d, body %q", code, body)
+		}
+	}
+
+	// Requests with a body are not
+	statuses := make(map[int]int)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("data"))
+		rec := httptest.NewRecorder()
+		Chain(b.Source(), OutputPipe).ServeHTTP(rec, req)
+		statuses[rec.Code]++
+	}
+	if statuses[http.StatusBadGateway] != 1 || statuses[http.StatusOK] != 2 {
+		t.Errorf("POST statuses %v", statuses)
+	}
+}
+
+func TestBalancerRetryUnavailable(t *testing.T) {
+	targets := testBackends(t, 2, func(i int, req *http.Request) int {
+		if i == 0 {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	})
+
+	b := NewBalancer(targets, BalancerOptions{Retries: 1})
+	defer b.Close()
+	for i := 0; i < 4; i++ {
+		if code, body := balancedGet(t, b, nil); code != http.StatusOK || body != "1" {
+			t.Errorf("status %d, body %q", code, body)
+		}
+	}
+
+	// If no other backend can be chosen, as when it has been ejected while
+	// the first was being tried, the 503 is passed on
+	calls := 0
+	first := func(backends []*Backend, req *http.Request) *Backend {
+		calls++
+		if calls%2 == 0 {
+			return nil
+		}
+		return backends[0]
+	}
+	b = NewBalancer(targets, BalancerOptions{Retries: 1, Strategy: first})
+	defer b.Close()
+	if code, body := balancedGet(t, b, nil); code != http.StatusServiceUnavailable || body != "0:503" {
+		t.Errorf("status %d, body %q", code, body)
+	}
+}
+
+func TestBalancerNoBackend(t *testing.T) {
+	b := NewBalancer(testBackends(t, 1, nil), BalancerOptions{})
+	defer b.Close()
+	backend := b.Backends()[0]
+	backend.mu.Lock()
+	backend.healthy = false
+	backend.mu.Unlock()
+
+	if code, _ := balancedGet(t, b, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", code)
+	}
+}
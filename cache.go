@@ -0,0 +1,542 @@
+package webpipes
+
+import "context"
+import "io"
+import "log"
+import "net/http"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+//////////////////////////////////////////////////////////////////////////////
+// Response caching
+//
+// A Cache is used as a pair of components. The lookup pipe goes at the head
+// of a chain and answers requests it holds a fresh response for, writing the
+// stored content out directly so the rest of the chain never runs. The store
+// filter goes immediately before the output pipe and keeps a copy of any
+// response that HTTP caching rules allow to be shared, as it is streamed to
+// the client:
+//
+//   cache := webpipes.NewCache(64 << 20)
+//   chain := webpipes.Chain(
+//       cache.Lookup(nil),
+//       webpipes.FileServer("../http-data", "/static/"),
+//       cache.Store(),
+//       webpipes.OutputPipe,
+//   )
+//   cache.Revalidate = chain
+//
+// The cache behaves as a shared cache as described by RFC 9111. Responses are
+// only stored with an explicit lifetime (max-age, s-maxage or Expires), never
+// when marked private, no-store or no-cache, and are kept separately for each
+// combination of the request headers named by Vary. A stale response with a
+// stale-while-revalidate lifetime is still served while it is refreshed in
+// the background, which needs Revalidate to be set to the handler the cache
+// is part of.
+
+// A cache of responses, kept in a CacheStore
+type Cache struct {
+	// The handler used to refresh stale responses in the background. If
+	// nil, stale responses are never served.
+	Revalidate http.Handler
+
+	store CacheStore
+
+	mu         sync.Mutex
+	refreshing map[string]bool
+}
+
+// Create a cache that holds up to 'maxBytes' bytes of responses in memory,
+// discarding the least recently used when it is full
+func NewCache(maxBytes int64) *Cache {
+	return NewCacheWithStore(NewMemoryStore(maxBytes))
+}
+
+// Create a cache that keeps its responses in 'store'
+func NewCacheWithStore(store CacheStore) *Cache {
+	return &Cache{
+		store:      store,
+		refreshing: make(map[string]bool),
+	}
+}
+
+// Return the number of bytes held by the cache
+func (c *Cache) Size() int64 {
+	return c.store.Size()
+}
+
+// Requests made to refresh a stale response carry this in their context, so
+// that the lookup pipe lets them through
+type revalidateKey struct{}
+
+// Return a pipe that answers GET and HEAD requests from the cache. A hit is
+// written out directly, or sent down 'bypass' in a network, after evaluating
+// any preconditions of the request against it. Requests that cannot be
+// answered from the cache are passed on.
+func (c *Cache) Lookup(bypass chan<- *Conn) Pipe {
+	return func(conn *Conn, req *http.Request) bool {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return true
+		}
+		if req.Context().Value(revalidateKey{}) != nil {
+			return true
+		}
+
+		reqCC := requestCacheControl(req)
+		if _, ok := reqCC["no-store"]; ok {
+			return true
+		}
+		resp, body, stale := c.get(req, reqCC)
+		if resp == nil {
+			if _, ok := reqCC["only-if-cached"]; ok {
+				conn.HTTPStatusResponse(http.StatusGatewayTimeout)
+				return bypassConn(conn, req, bypass)
+			}
+			return true
+		}
+		if stale {
+			c.refresh(req, resp.Key)
+		}
+
+		header := conn.rwriter.Header()
+		for key, values := range resp.Header {
+			header[key] = append([]string(nil), values...)
+		}
+		age := time.Since(resp.Date) / time.Second
+		conn.SetHeader("Age", strconv.FormatInt(int64(age), 10))
+		conn.SetStatus(resp.Status)
+
+		writer := conn.NewContentWriter()
+		if writer == nil {
+			body.Close()
+		} else {
+			conn.Go(func() {
+				io.Copy(writer, body)
+				body.Close()
+				writer.Close()
+			})
+		}
+		ConditionalPipe(conn, req)
+		return bypassConn(conn, req, bypass)
+	}
+}
+
+// Return a filter that stores responses that may be cached as they are sent.
+// It must be the last component before the output pipe. Responses to other
+// methods than GET and HEAD remove any responses stored for the URL.
+func (c *Cache) Store() Filter {
+	return func(conn *Conn, req *http.Request, reader io.ReadCloser, writer io.WriteCloser) bool {
+		if req.Method != "GET" {
+			// Only responses to GET are stored, so there is nothing to keep
+			conn.BeforeOutput(func() {
+				if req.Method != "HEAD" && conn.status < 400 {
+					c.store.Delete(primaryCacheKey(req))
+				}
+			})
+			conn.Go(func() {
+				io.Copy(writer, reader)
+				reader.Close()
+				writer.Close()
+			})
+			return true
+		}
+
+		// Only what is sent unchanged as a complete response is stored,
+		// which is decided once the other components have had their say
+		representation := conn.Representation()
+		decided := make(chan struct{})
+		var resp *CachedResponse
+		conn.BeforeOutput(func() {
+			if conn.Representation() == representation {
+				resp = newCachedResponse(conn, req)
+			}
+			close(decided)
+		})
+
+		// Wait for the decision, reporting false if the connection is
+		// abandoned before it is made
+		wait := func() bool {
+			select {
+			case <-decided:
+				return true
+			case <-conn.Context().Done():
+				// The response may have been sent regardless
+				select {
+				case <-decided:
+					return true
+				default:
+					return false
+				}
+			}
+		}
+
+		// The decision is made before the output pipe reads any content, so
+		// the store is only written to once it is known to be wanted
+		capture := &cacheCapture{open: func() CacheWriter {
+			if !wait() || resp == nil {
+				return nil
+			}
+			cw, err := c.store.Create()
+			if err != nil {
+				log.Printf("webpipes: cannot cache %s: %s", req.URL, err)
+				return nil
+			}
+			return cw
+		}}
+
+		conn.Go(func() {
+			_, err := io.Copy(io.MultiWriter(writer, capture), reader)
+			reader.Close()
+			writer.Close()
+			if err != nil || capture.failed || !wait() || resp == nil {
+				capture.abort()
+				return
+			}
+
+			// An empty body is never written, so the writer may not be
+			// open yet
+			cw := capture.start()
+			if cw == nil {
+				return
+			}
+			if err := c.commit(req, resp, cw); err != nil && err != ErrCacheEntryTooLarge {
+				log.Printf("webpipes: cannot cache %s: %s", req.URL, err)
+			}
+		})
+		return true
+	}
+}
+
+// Return a new response to be stored for the response being sent on 'conn',
+// or nil if it may not be stored. It is keyed on the URL alone.
+func newCachedResponse(conn *Conn, req *http.Request) *CachedResponse {
+	if req.Method != "GET" || !cacheableStatus[conn.status] {
+		return nil
+	}
+	if _, ok := requestCacheControl(req)["no-store"]; ok {
+		return nil
+	}
+
+	header := conn.rwriter.Header().Clone()
+	cc := parseCacheControl(header.Values("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return nil
+		}
+	}
+	if header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	_, public := cc["public"]
+	_, shared := cc["s-maxage"]
+	_, mustRevalidate := cc["must-revalidate"]
+	if req.Header.Get("Authorization") != "" && !public && !shared && !mustRevalidate {
+		return nil
+	}
+	for _, field := range varyFields(header) {
+		if field == "*" {
+			return nil
+		}
+	}
+
+	now := time.Now()
+	date := now
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		date = now.Add(-time.Duration(age) * time.Second)
+	}
+	header.Del("Age")
+
+	resp := &CachedResponse{
+		Key:      primaryCacheKey(req),
+		Status:   conn.status,
+		Header:   header,
+		Date:     date,
+		Lifetime: freshnessLifetime(header, cc, now),
+	}
+	if resp.Lifetime <= 0 {
+		return nil
+	}
+	if !mustRevalidate {
+		if _, ok := cc["proxy-revalidate"]; !ok {
+			resp.StaleWhile = directiveSeconds(cc, "stale-while-revalidate")
+		}
+	}
+	return resp
+}
+
+// Responses that vary on request headers are stored under a key that
+// includes the values of those headers. So that they can be found, a marker
+// with a status of 0 is stored under the URL alone, giving the headers the
+// responses vary on. The date of the marker is also part of the keys, so that
+// replacing or removing the marker makes the responses it led to unreachable,
+// to be discarded by the store in due course.
+
+// Return the response stored for 'req' along with its body, and whether it is
+// stale and should be refreshed
+func (c *Cache) get(req *http.Request, reqCC map[string]string) (*CachedResponse, io.ReadCloser, bool) {
+	if _, ok := reqCC["no-cache"]; ok {
+		return nil, nil, false
+	}
+
+	resp, body := c.store.Get(primaryCacheKey(req))
+	if resp != nil && resp.Status == 0 {
+		body.Close()
+		resp, body = c.store.Get(variantCacheKey(resp, req))
+	}
+	if resp == nil {
+		return nil, nil, false
+	}
+
+	age := time.Since(resp.Date)
+	fresh := age < resp.Lifetime
+	if maxAge, ok := reqCC["max-age"]; ok {
+		if n, err := strconv.Atoi(maxAge); err == nil && age > time.Duration(n)*time.Second {
+			body.Close()
+			return nil, nil, false
+		}
+	}
+	if fresh {
+		return resp, body, false
+	}
+
+	if age < resp.Lifetime+resp.StaleWhile && c.Revalidate != nil {
+		return resp, body, true
+	}
+	body.Close()
+	c.store.Delete(resp.Key)
+	return nil, nil, false
+}
+
+// Store a response that is keyed on the URL, under a variant key if it
+// varies on request headers
+func (c *Cache) commit(req *http.Request, resp *CachedResponse, cw CacheWriter) error {
+	vary := varyFields(resp.Header)
+	if len(vary) == 0 {
+		return cw.Commit(resp)
+	}
+
+	marker, body := c.store.Get(resp.Key)
+	if marker != nil {
+		body.Close()
+	}
+	if marker == nil || marker.Status != 0 || !sameFields(varyFields(marker.Header), vary) {
+		marker = &CachedResponse{
+			Key:    resp.Key,
+			Header: http.Header{"Vary": {strings.Join(vary, ", ")}},
+			Date:   time.Now(),
+		}
+		mw, err := c.store.Create()
+		if err != nil {
+			cw.Abort()
+			return err
+		}
+		if err := mw.Commit(marker); err != nil {
+			cw.Abort()
+			return err
+		}
+	}
+
+	resp.Key = variantCacheKey(marker, req)
+	return cw.Commit(resp)
+}
+
+// Refresh the response stored under 'key' by running 'req' through the
+// Revalidate handler in the background, unless that is already happening
+func (c *Cache) refresh(req *http.Request, key string) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	handler := c.Revalidate
+	c.mu.Unlock()
+
+	ctx := context.WithValue(context.WithoutCancel(req.Context()), revalidateKey{}, true)
+	breq := req.Clone(ctx)
+	breq.Method = "GET"
+	breq.Body = http.NoBody
+	breq.ContentLength = 0
+	for _, field := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range"} {
+		breq.Header.Del(field)
+	}
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+		handler.ServeHTTP(&discardResponse{header: make(http.Header)}, breq)
+	}()
+}
+
+// listed by RFC 9110
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	308: true, 404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Return the key that identifies the URL of a request
+func primaryCacheKey(req *http.Request) string {
+	return strings.ToLower(req.Host) + req.URL.RequestURI()
+}
+
+// Return the key that a response varying on the headers given by 'marker'
+// is stored under
+func variantCacheKey(marker *CachedResponse, req *http.Request) string {
+	var key strings.Builder
+	key.WriteString(marker.Key)
+	key.WriteString("\n")
+	key.WriteString(strconv.FormatInt(marker.Date.UnixNano(), 36))
+	for _, field := range varyFields(marker.Header) {
+		key.WriteString("\n")
+		key.WriteString(field)
+		key.WriteString(":")
+		key.WriteString(strings.Join(req.Header.Values(field), ","))
+	}
+	return key.String()
+}
+
+// Return the canonical names of the header fields listed in Vary
+func varyFields(header http.Header) []string {
+	var fields []string
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	return fields
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse Cache-Control header values into a map from the lowercased
+// directive names to their unquoted arguments
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// Return the Cache-Control directives of a request, treating the obsolete
+// Pragma: no-cache as Cache-Control: no-cache
+func requestCacheControl(req *http.Request) map[string]string {
+	cc := parseCacheControl(req.Header.Values("Cache-Control"))
+	if len(cc) == 0 && strings.EqualFold(req.Header.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	if cc["max-age"] == "0" {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+// Return the number of seconds given as the argument of a directive
+func directiveSeconds(cc map[string]string, name string) time.Duration {
+	n, err := strconv.ParseInt(cc[name], 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Return how long a response stays fresh for a shared cache, from s-maxage,
+// max-age or Expires in that order of preference
+func freshnessLifetime(header http.Header, cc map[string]string, now time.Time) time.Duration {
+	if _, ok := cc["s-maxage"]; ok {
+		return directiveSeconds(cc, "s-maxage")
+	}
+	if _, ok := cc["max-age"]; ok {
+		return directiveSeconds(cc, "max-age")
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return t.Sub(date)
+	}
+	return 0
+}
+
+// Passes the content on to a CacheWriter until it fails, but always claims
+// success so as not to interrupt the response. The writer is opened with
+// 'open' when it is first needed, and nothing is written if that gives nil.
+type cacheCapture struct {
+	open   func() CacheWriter
+	writer CacheWriter
+	opened bool
+	failed bool
+}
+
+// Return the writer, opening it if that has not been tried yet
+func (cc *cacheCapture) start() CacheWriter {
+	if !cc.opened {
+		cc.opened = true
+		cc.writer = cc.open()
+	}
+	return cc.writer
+}
+
+func (cc *cacheCapture) Write(p []byte) (int, error) {
+	if cc.failed {
+		return len(p), nil
+	}
+	if cw := cc.start(); cw != nil {
+		if _, err := cw.Write(p); err != nil {
+			cc.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+// Discard anything written so far
+func (cc *cacheCapture) abort() {
+	if cc.writer != nil {
+		cc.writer.Abort()
+	}
+}
+
+// A ResponseWriter that throws the response away, for requests made on
+// behalf of the cache
+type discardResponse struct {
+	header http.Header
+}
+
+func (dr *discardResponse) Header() http.Header {
+	return dr.header
+}
+
+func (dr *discardResponse) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (dr *discardResponse) WriteHeader(status int) {
+}
@@ -0,0 +1,321 @@
+package webpipes
+
+import "context"
+import "fmt"
+import "io"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// A store that counts the writers it creates and the responses committed
+type countingStore struct {
+	CacheStore
+	creates, commits atomic.Int32
+}
+
+func (cs *countingStore) Create() (CacheWriter, error) {
+	cs.creates.Add(1)
+	cw, err := cs.CacheStore.Create()
+	if err != nil {
+		return nil, err
+	}
+	return &countedWriter{cw, cs}, nil
+}
+
+type countedWriter struct {
+	CacheWriter
+	store *countingStore
+}
+
+func (cw *countedWriter) Commit(resp *CachedResponse) error {
+	err := cw.CacheWriter.Commit(resp)
+	cw.store.commits.Add(1)
+	return err
+}
+
+// Wait for 'n' responses to have been committed, since they are stored
+// after the response has been sent
+func (cs *countingStore) wait(t *testing.T, n int32) {
+	t.Helper()
+	for i := 0; i < 200 && cs.commits.Load() < n; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := cs.commits.Load(); got != n {
+		t.Fatalf("%d responses committed, want %d", got, n)
+	}
+}
+
+// A source that numbers its responses, with the given header fields given
+// as pairs of names and values. The Accept-Language of the request is
+// included in the body.
+func cacheSource(calls *atomic.Int32, fields ...string) Source {
+	return func(conn *Conn, req *http.Request, writer io.WriteCloser) bool {
+		n := calls.Add(1)
+		conn.SetStatus(http.StatusOK)
+		for i := 0; i+1 < len(fields); i += 2 {
+			conn.SetHeader(fields[i], fields[i+1])
+		}
+		conn.Go(func() {
+			fmt.Fprintf(writer, "%sresponse %d", req.Header.Get("Accept-Language"), n)
+			writer.Close()
+		})
+		return true
+	}
+}
+
+// Set up a cache in front of a source with the given header fields
+func newTestCache(fields ...string) (*countingStore, *atomic.Int32, http.Handler) {
+	store := &countingStore{CacheStore: NewMemoryStore(1 << 20)}
+	cache := NewCacheWithStore(store)
+	calls := new(atomic.Int32)
+	chain := Chain(cache.Lookup(nil), cacheSource(calls, fields...), cache.Store(), OutputPipe)
+	return store, calls, chain
+}
+
+func cacheRequest(handler http.Handler, method string, fields ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://example.com/page", nil)
+	for i := 0; i+1 < len(fields); i += 2 {
+		req.Header.Set(fields[i], fields[i+1])
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func checkBody(t *testing.T, rec *httptest.ResponseRecorder, want string) {
+	t.Helper()
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("status %d, body %q, want %q", rec.Code, rec.Body, want)
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	store, calls, chain := newTestCache("Cache-Control", "max-age=60", "ETag", `"v1"`)
+
+	checkBody(t, cacheRequest(chain, "GET"), "response 1")
+	store.wait(t, 1)
+	rec := cacheRequest(chain, "GET")
+	checkBody(t, rec, "response 1")
+	if rec.Header().Get("Age") == "" {
+		t.Errorf("cached response has no Age")
+	}
+
+	// Conditional requests are answered from the cache
+	if rec := cacheRequest(chain, "GET", "If-None-Match", `"v1"`); rec.Code != http.StatusNotModified {
+		t.Errorf("conditional request: status %d, want 304", rec.Code)
+	}
+
+	// The client can ask for a fresher response than the cache holds
+	checkBody(t, cacheRequest(chain, "GET", "Cache-Control", "max-age=0"), "response 2")
+	store.wait(t, 2)
+	checkBody(t, cacheRequest(chain, "GET", "Cache-Control", "max-age=60"), "response 2")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("%d calls to the source, want 2", n)
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name           string
+		fields         []string
+		stored, served bool
+	}{
+		{"max-age", []string{"Cache-Control", "max-age=60"}, true, true},
+		{"s-maxage", []string{"Cache-Control", "max-age=0, s-maxage=60"}, true, true},
+		{"expires", []string{"Expires", expires}, true, true},
+		{"max-age over expires", []string{"Cache-Control", "max-age=0", "Expires", expires}, false, false},
+		{"no lifetime", nil, false, false},
+
+		// Stored, but too old to be served without revalidation
+		{"already stale", []string{"Cache-Control", "max-age=60", "Age", "120"}, true, false},
+	}
+	for _, test := range tests {
+		store, calls, chain := newTestCache(test.fields...)
+		cacheRequest(chain, "GET")
+		if test.stored {
+			store.wait(t, 1)
+		}
+		cacheRequest(chain, "GET")
+
+		want := int32(2)
+		if test.served {
+			want = 1
+		}
+		if n := calls.Load(); n != want {
+			t.Errorf("%s: %d calls to the source, want %d", test.name, n, want)
+		}
+		if !test.stored && store.creates.Load() != 0 {
+			t.Errorf("%s: cache writer created", test.name)
+		}
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	store, calls, chain := newTestCache("Cache-Control", "max-age=60", "Vary", "Accept-Language")
+
+	checkBody(t, cacheRequest(chain, "GET", "Accept-Language", "en"), "enresponse 1")
+	store.wait(t, 2) // the marker and the response
+	checkBody(t, cacheRequest(chain, "GET", "Accept-Language", "fr"), "frresponse 2")
+	store.wait(t, 3)
+
+	checkBody(t, cacheRequest(chain, "GET", "Accept-Language", "en"), "enresponse 1")
+	checkBody(t, cacheRequest(chain, "GET", "Accept-Language", "fr"), "frresponse 2")
+	checkBody(t, cacheRequest(chain, "GET"), "response 3")
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d calls to the source, want 3", n)
+	}
+
+	// Responses that vary on everything are not stored
+	store, calls, chain = newTestCache("Cache-Control", "max-age=60", "Vary", "*")
+	cacheRequest(chain, "GET")
+	cacheRequest(chain, "GET")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Vary *: %d calls to the source, want 2", n)
+	}
+	if n := store.creates.Load(); n != 0 {
+		t.Errorf("Vary *: %d cache writers created", n)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  []string
+		request []string
+	}{
+		{"no-store", []string{"Cache-Control", "max-age=60, no-store"}, nil},
+		{"private", []string{"Cache-Control", "max-age=60, private"}, nil},
+		{"no-cache", []string{"Cache-Control", "max-age=60, no-cache"}, nil},
+		{"cookie", []string{"Cache-Control", "max-age=60", "Set-Cookie", "a=b"}, nil},
+		{"authorized", []string{"Cache-Control", "max-age=60"}, []string{"Authorization", "Basic eDp5"}},
+		{"request no-store", []string{"Cache-Control", "max-age=60"}, []string{"Cache-Control", "no-store"}},
+	}
+	for _, test := range tests {
+		store, calls, chain := newTestCache(test.fields...)
+		cacheRequest(chain, "GET", test.request...)
+		cacheRequest(chain, "GET", test.request...)
+		if n := calls.Load(); n != 2 {
+			t.Errorf("%s: %d calls to the source, want 2", test.name, n)
+		}
+		if n := store.creates.Load(); n != 0 {
+			t.Errorf("%s: %d cache writers created", test.name, n)
+		}
+	}
+
+	// A request with no-cache goes to the source, but the response it gets
+	// is stored for later requests
+	store, calls, chain := newTestCache("Cache-Control", "max-age=60")
+	cacheRequest(chain, "GET")
+	store.wait(t, 1)
+	checkBody(t, cacheRequest(chain, "GET", "Cache-Control", "no-cache"), "response 2")
+	store.wait(t, 2)
+	checkBody(t, cacheRequest(chain, "GET"), "response 2")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("no-cache request: %d calls to the source, want 2", n)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	store, calls, chain := newTestCache("Cache-Control", "max-age=60")
+
+	cacheRequest(chain, "GET")
+	store.wait(t, 1)
+	checkBody(t, cacheRequest(chain, "GET"), "response 1")
+
+	// HEAD is answered from the cache, unsafe methods remove the response
+	if rec := cacheRequest(chain, "HEAD"); rec.Code != http.StatusOK || rec.Header().Get("Age") == "" {
+		t.Errorf("HEAD: status %d, not from the cache", rec.Code)
+	}
+	checkBody(t, cacheRequest(chain, "POST"), "response 2")
+	checkBody(t, cacheRequest(chain, "GET"), "response 3")
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d calls to the source, want 3", n)
+	}
+	if n := store.creates.Load(); n != 2 {
+		t.Errorf("%d cache writers created, want 2 for the GET requests", n)
+	}
+}
+
+func TestCacheLookupNetwork(t *testing.T) {
+	store := &countingStore{CacheStore: NewMemoryStore(1 << 20)}
+	cache := NewCacheWithStore(store)
+	calls := new(atomic.Int32)
+	handler := NetworkHandler(cache.Lookup(nil), cacheSource(calls, "Cache-Control", "max-age=60"), cache.Store(), OutputPipe)
+
+	if rec := cacheRequest(handler, "GET", "Cache-Control", "only-if-cached"); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("only-if-cached: status %d, want 504", rec.Code)
+	}
+	checkBody(t, cacheRequest(handler, "GET"), "response 1")
+	store.wait(t, 1)
+	for i := 0; i < 10; i++ {
+		checkBody(t, cacheRequest(handler, "GET"), "response 1")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %s", err)
+	}
+}
+
+// Store 'body' under 'key' in 'store'
+func putCached(t *testing.T, store CacheStore, key, body string) error {
+	t.Helper()
+	cw, err := store.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(cw, body); err != nil {
+		cw.Abort()
+		return err
+	}
+	return cw.Commit(&CachedResponse{Key: key, Status: http.StatusOK, Header: http.Header{}})
+}
+
+// Return the body stored under 'key', or "-" if there is none
+func getCached(store CacheStore, key string) string {
+	resp, body := store.Get(key)
+	if resp == nil {
+		return "-"
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(body)
+	return string(data)
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	// Each entry takes ten bytes, counting its key
+	store := NewMemoryStore(30)
+	for _, key := range []string{"a", "b", "c"} {
+		putCached(t, store, key, strings.Repeat(key, 9))
+	}
+	getCached(store, "a")
+	putCached(t, store, "d", strings.Repeat("d", 9))
+
+	for key, want := range map[string]string{"a": "aaaaaaaaa", "b": "-", "c": "ccccccccc", "d": "ddddddddd"} {
+		if got := getCached(store, key); got != want {
+			t.Errorf("%s: %q, want %q", key, got, want)
+		}
+	}
+	if size := store.Size(); size != 30 {
+		t.Errorf("size %d, want 30", size)
+	}
+
+	// Replacing an entry doesn't count it twice
+	putCached(t, store, "a", "A")
+	if size := store.Size(); size != 22 {
+		t.Errorf("size %d after replacing, want 22", size)
+	}
+
+	if err := putCached(t, store, "e", strings.Repeat("e", 40)); err != ErrCacheEntryTooLarge {
+		t.Errorf("storing too much: %v", err)
+	}
+	store.Delete("c")
+	if got := getCached(store, "c"); got != "-" || store.Size() != 12 {
+		t.Errorf("after delete: %q, size %d", got, store.Size())
+	}
+}
@@ -0,0 +1,196 @@
+package webpipes
+
+import "bytes"
+import "container/list"
+import "errors"
+import "io"
+import "net/http"
+import "sync"
+import "time"
+
+//////////////////////////////////////////////////////////////////////////////
+// Cache storage
+//
+// A Cache decides what may be stored and for how long, and leaves keeping the
+// responses to a CacheStore. MemoryStore keeps them on the heap, which suits
+// small and frequently requested content, while DiskStore keeps them in a
+// directory so that large content such as images can be cached without
+// holding it in memory. Either may be handed to NewCacheWithStore.
+
+// A response held by a cache store. The body is kept separately.
+type CachedResponse struct {
+	// The key the response is stored under
+	Key string
+
+	Status int
+	Header http.Header
+
+	// The time the response was generated, accounting for any Age it had
+	// when it was received
+	Date time.Time
+
+	// How long the response stays fresh, and how much longer after that it
+	// may be served while it is refreshed in the background
+	Lifetime   time.Duration
+	StaleWhile time.Duration
+
+	// The length of the body, filled in by the store
+	Size int64
+}
+
+// The interface to storage used by a Cache. Implementations must be safe for
+// concurrent use, and bound the space they use by discarding the least
+// recently used responses.
+type CacheStore interface {
+	// Return the response stored under 'key' and a reader for its body,
+	// marking it as recently used, or nil if there is none
+	Get(key string) (*CachedResponse, io.ReadCloser)
+
+	// Start storing a new response, by writing its body to the returned
+	// CacheWriter
+	Create() (CacheWriter, error)
+
+	// Remove the response stored under 'key', if any
+	Delete(key string)
+
+	// Return the number of bytes in use
+	Size() int64
+}
+
+// Receives the body of a response being stored. Nothing is stored until
+// Commit is called, and either Commit or Abort must be called once the body
+// has been written. A write fails if the body cannot be stored, for instance
+// because it is too large.
+type CacheWriter interface {
+	io.Writer
+
+	// Store the body written so far along with 'resp', replacing any
+	// response already stored under resp.Key
+	Commit(resp *CachedResponse) error
+
+	// Discard the body written so far
+	Abort()
+}
+
+// Returned by a CacheWriter when the body is larger than the store can hold
+var ErrCacheEntryTooLarge = errors.New("webpipes: response too large to cache")
+
+//////////////////////////////////////////////////////////////////////////////
+// Memory storage
+
+// A CacheStore that keeps responses in memory
+type MemoryStore struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	resp *CachedResponse
+	body []byte
+}
+
+// Create a store that holds up to 'maxBytes' bytes of responses, counting
+// their headers as well as their bodies
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (ms *MemoryStore) Get(key string) (*CachedResponse, io.ReadCloser) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	elem := ms.entries[key]
+	if elem == nil {
+		return nil, nil
+	}
+	ms.lru.MoveToFront(elem)
+	entry := elem.Value.(*memoryEntry)
+	return entry.resp, io.NopCloser(bytes.NewReader(entry.body))
+}
+
+func (ms *MemoryStore) Create() (CacheWriter, error) {
+	return &memoryWriter{store: ms}, nil
+}
+
+func (ms *MemoryStore) Delete(key string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if elem := ms.entries[key]; elem != nil {
+		ms.remove(elem)
+	}
+}
+
+func (ms *MemoryStore) Size() int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.size
+}
+
+// Store an entry, evicting the least recently used to make room
+func (ms *MemoryStore) put(entry *memoryEntry) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if elem := ms.entries[entry.resp.Key]; elem != nil {
+		ms.remove(elem)
+	}
+	ms.entries[entry.resp.Key] = ms.lru.PushFront(entry)
+	ms.size += entry.size()
+
+	for ms.size > ms.maxBytes {
+		ms.remove(ms.lru.Back())
+	}
+}
+
+// Remove an entry. The mutex must be held.
+func (ms *MemoryStore) remove(elem *list.Element) {
+	entry := ms.lru.Remove(elem).(*memoryEntry)
+	delete(ms.entries, entry.resp.Key)
+	ms.size -= entry.size()
+}
+
+// Return an estimate of the memory used by the entry
+func (entry *memoryEntry) size() int64 {
+	size := int64(len(entry.resp.Key) + len(entry.body))
+	for key, values := range entry.resp.Header {
+		for _, value := range values {
+			size += int64(len(key) + len(value))
+		}
+	}
+	return size
+}
+
+type memoryWriter struct {
+	store *MemoryStore
+	buf   bytes.Buffer
+}
+
+func (mw *memoryWriter) Write(p []byte) (int, error) {
+	if int64(mw.buf.Len()+len(p)) > mw.store.maxBytes {
+		return 0, ErrCacheEntryTooLarge
+	}
+	return mw.buf.Write(p)
+}
+
+func (mw *memoryWriter) Commit(resp *CachedResponse) error {
+	entry := &memoryEntry{resp: resp, body: mw.buf.Bytes()}
+	resp.Size = int64(len(entry.body))
+	if entry.size() > mw.store.maxBytes {
+		return ErrCacheEntryTooLarge
+	}
+	mw.store.put(entry)
+	return nil
+}
+
+func (mw *memoryWriter) Abort() {
+	mw.buf.Reset()
+}
@@ -0,0 +1,594 @@
+package webpipes
+
+import "bufio"
+import "context"
+import "errors"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "net/textproto"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+//////////////////////////////////////////////////////////////////////////////
+// Gateway interfaces
+//
+// CGI and the protocols that grew out of it (FastCGI, SCGI and uwsgi) all
+// describe the request to the application with the same set of variables,
+// and all have the application answer with a block of CGI headers followed
+// by the body. The environment is built here as net/http/cgi builds it, so
+// that an application behaves the same whichever way it is reached.
+
+// Options for the sources that talk to an application server over a socket
+type GatewayOptions struct {
+	// The most connections to open to the application server at once,
+	// unlimited if zero. Requests wait for a connection to become free.
+	MaxConns int
+
+	// How many idle connections to keep for later requests, 2 if zero. Only
+	// FastCGI keeps connections open: SCGI and uwsgi send one request per
+	// connection, which the application closes to end its response, so
+	// they ignore this.
+	MaxIdle int
+
+	// How long to wait for a connection to be made, 10 seconds if zero
+	DialTimeout time.Duration
+
+	// If not zero, how long to wait for the application to start
+	// responding before giving up with a 504
+	Timeout time.Duration
+
+	// Where anything the application writes to its error stream is logged,
+	// the standard logger if nil
+	Stderr *log.Logger
+
+	// Extra variables to pass to the application, as "NAME=value"
+	Env []string
+
+	// For FastCGI, send several requests over each connection at once.
+	// The application server must support this.
+	Multiplex bool
+
+	// The largest request body of unknown length that is read in full to
+	// find its length, 32MB if zero and unlimited if negative. Larger bodies
+	// are refused with a 413. Bodies of known length are not limited, so
+	// put MaxBodySize before the source to limit those too.
+	MaxSpooledBody int64
+}
+
+// Fill in the defaults for the options that have them
+func (opts *GatewayOptions) defaults() {
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = 2
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 10 * time.Second
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = log.Default()
+	}
+	if opts.MaxSpooledBody == 0 {
+		opts.MaxSpooledBody = defaultMaxSpooledBody
+	}
+}
+
+// The variables describing a request, in the order they were added
+type cgiEnv []cgiVar
+
+type cgiVar struct {
+	name, value string
+}
+
+// Set a variable, replacing any existing value
+func (env *cgiEnv) set(name, value string) {
+	for i := range *env {
+		if (*env)[i].name == name {
+			(*env)[i].value = value
+			return
+		}
+	}
+	*env = append(*env, cgiVar{name, value})
+}
+
+// Return the value of a variable, or the empty string
+func (env cgiEnv) get(name string) string {
+	for _, v := range env {
+		if v.name == name {
+			return v.value
+		}
+	}
+	return ""
+}
+
+// Add variables given as "NAME=value"
+func (env *cgiEnv) setAll(vars []string) {
+	for _, v := range vars {
+		if name, value, ok := strings.Cut(v, "="); ok {
+			env.set(name, value)
+		}
+	}
+}
+
+// Build the environment for 'req', as net/http/cgi does. 'scriptName' is the
+// part of the path that identifies the application and 'pathInfo' the rest.
+func newCGIEnv(conn *Conn, req *http.Request, scriptName, pathInfo, scriptFilename string) cgiEnv {
+	port := "80"
+	if req.TLS != nil {
+		port = "443"
+	}
+	serverName := req.Host
+	if host, p, err := net.SplitHostPort(req.Host); err == nil {
+		serverName, port = host, p
+	}
+
+	var env cgiEnv
+	env.set("SERVER_SOFTWARE", "webpipes")
+	env.set("SERVER_NAME", serverName)
+	env.set("SERVER_PROTOCOL", "HTTP/1.1")
+	env.set("SERVER_PORT", port)
+	env.set("HTTP_HOST", req.Host)
+	env.set("GATEWAY_INTERFACE", "CGI/1.1")
+	env.set("REQUEST_METHOD", req.Method)
+	env.set("QUERY_STRING", req.URL.RawQuery)
+	env.set("REQUEST_URI", req.URL.RequestURI())
+	env.set("PATH_INFO", pathInfo)
+	env.set("SCRIPT_NAME", scriptName)
+	env.set("SCRIPT_FILENAME", scriptFilename)
+
+	if ip, p, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		env.set("REMOTE_ADDR", ip)
+		env.set("REMOTE_HOST", ip)
+		env.set("REMOTE_PORT", p)
+	} else {
+		env.set("REMOTE_ADDR", req.RemoteAddr)
+		env.set("REMOTE_HOST", req.RemoteAddr)
+	}
+	if conn.User() != "" {
+		env.set("AUTH_TYPE", "Basic")
+		env.set("REMOTE_USER", conn.User())
+	}
+	if req.TLS != nil {
+		env.set("HTTPS", "on")
+	}
+
+	for key, values := range req.Header {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if name == "PROXY" {
+			// Guard against httpoxy
+			continue
+		}
+		sep := ", "
+		if name == "COOKIE" {
+			sep = "; "
+		}
+		env.set("HTTP_"+name, strings.Join(values, sep))
+	}
+	if req.ContentLength > 0 {
+		env.set("CONTENT_LENGTH", strconv.FormatInt(req.ContentLength, 10))
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		env.set("CONTENT_TYPE", contentType)
+	}
+	return env
+}
+
+// Returned when an application's response cannot be understood
+var ErrBadCGIResponse = errors.New("webpipes: malformed CGI response")
+
+// The most header data accepted from an application
+const maxCGIHeaderBytes = 1 << 20
+
+// Read the block of CGI headers at the start of an application's response.
+// The status comes from the Status header, or from an HTTP status line such
+// as non-parsed-header scripts send, and defaults to 302 when there is a
+// Location header and 200 otherwise.
+func readCGIHeader(r *bufio.Reader) (int, http.Header, error) {
+	header := make(http.Header)
+	status := 0
+	read := 0
+
+	for first := true; ; first = false {
+		line, err := r.ReadString('\n')
+		read += len(line)
+		if read > maxCGIHeaderBytes {
+			return 0, nil, fmt.Errorf("%w: header too large", ErrBadCGIResponse)
+		}
+		if err != nil {
+			if len(header) == 0 && status == 0 && line == "" {
+				return 0, nil, fmt.Errorf("%w: no headers", ErrBadCGIResponse)
+			}
+			return 0, nil, fmt.Errorf("%w: %s", ErrBadCGIResponse, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		if first && strings.HasPrefix(line, "HTTP/") {
+			_, code, _ := strings.Cut(line, " ")
+			if status, err = parseCGIStatus(code); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || key == "" {
+			// Ignored, as net/http/cgi does
+			continue
+		}
+		key = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if key == "Status" {
+			if status, err = parseCGIStatus(value); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		header.Add(key, value)
+	}
+
+	if status == 0 {
+		if header.Get("Location") != "" {
+			status = http.StatusFound
+		} else if header.Get("Content-Type") == "" {
+			return 0, nil, fmt.Errorf("%w: missing required Content-Type", ErrBadCGIResponse)
+		} else {
+			status = http.StatusOK
+		}
+	}
+	return status, header, nil
+}
+
+// Parse a status such as "404 Not Found"
+func parseCGIStatus(value string) (int, error) {
+	code, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+	status, err := strconv.Atoi(code)
+	if err != nil || status < 100 || status > 999 {
+		return 0, fmt.Errorf("%w: bad status %q", ErrBadCGIResponse, value)
+	}
+	return status, nil
+}
+
+// Set the status and headers of the response on 'conn'
+func applyCGIHeader(conn *Conn, status int, header http.Header) {
+	dst := conn.rwriter.Header()
+	for key, values := range header {
+		dst[key] = values
+	}
+	conn.SetStatus(status)
+}
+
+// Log what an application has written to its error stream, a line at a time
+func logStderr(logger *log.Logger, name string, data []byte) {
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\r\n"), "\n") {
+		logger.Printf("%s: %s", name, strings.TrimRight(line, "\r"))
+	}
+}
+
+// A request that has been sent to an application server
+type gatewayResponse struct {
+	// The response of the application
+	body *bufio.Reader
+
+	// Ends the request, abandoning it if it is still in progress
+	abort func()
+}
+
+// Send a request to an application server with 'start' and read the CGI
+// headers of its response, setting them on 'conn'. If 'timeout' is not zero
+// and the headers have not arrived by then, the request is abandoned and
+// ErrUpstreamTimeout returned.
+func gatewayHeader(conn *Conn, timeout time.Duration, start func(context.Context) (*gatewayResponse, error)) (*gatewayResponse, error) {
+	ctx, cancel := context.WithCancelCause(conn.Context())
+	defer cancel(nil)
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			cancel(ErrUpstreamTimeout)
+		})
+		defer timer.Stop()
+	}
+
+	type result struct {
+		resp   *gatewayResponse
+		status int
+		header http.Header
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := start(ctx)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		stop := context.AfterFunc(ctx, resp.abort)
+		status, header, err := readCGIHeader(resp.body)
+		stop()
+		done <- result{resp, status, header, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		// Whatever was started is abandoned once it is known
+		go func() {
+			if r := <-done; r.resp != nil {
+				r.resp.abort()
+			}
+		}()
+		return nil, context.Cause(ctx)
+	}
+	if r.err != nil {
+		if r.resp != nil {
+			r.resp.abort()
+		}
+		return nil, r.err
+	}
+
+	applyCGIHeader(conn, r.status, r.header)
+	context.AfterFunc(conn.Context(), r.resp.abort)
+	return r.resp, nil
+}
+
+// Send the rest of the application's response down the pipeline
+func gatewayBody(conn *Conn, resp *gatewayResponse, writer io.WriteCloser) {
+	conn.Go(func() {
+		_, err := io.Copy(writer, resp.body)
+		resp.abort()
+		if err != nil && conn.Context().Err() == nil {
+			log.Printf("webpipes: error reading application response for %s: %s", conn.Request.URL, err)
+		}
+		writer.Close()
+	})
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// CGI scripts
+//
+// A script is run for each request, with the request body as its standard
+// input, and its standard output read as a CGI response. The script is
+// started in a process group of its own where the system has them, so that
+// when it has to be stopped anything it has started is stopped too.
+
+// Options for a CGI server
+type CGIOptions struct {
+	// If not zero, how long the script may run. It is then killed along
+	// with anything it has started, and the request answered with a 504 if
+	// the script had not yet responded.
+	Timeout time.Duration
+
+	// If not zero, the most output accepted from the script, including its
+	// headers. A script that writes more is killed, and its response cut
+	// short.
+	MaxOutput int64
+
+	// The directory to run the script in, the directory containing the
+	// script if empty
+	Dir string
+
+	// Extra variables to pass to the script, as "NAME=value"
+	Env []string
+
+	// The names of the variables in the environment of the server that are
+	// passed on to the script. Only PATH, and the variables the system
+	// needs to find shared libraries, are passed on otherwise.
+	InheritEnv []string
+
+	// The arguments to run the script with
+	Args []string
+
+	// Where anything the script writes to its error stream is logged, the
+	// standard logger if nil
+	Stderr *log.Logger
+
+	// If not zero, how many copies of the script may run at once. Other
+	// requests wait for one to finish, for up to Timeout.
+	MaxConcurrent int
+
+	// The largest request body of unknown length that is read in full to
+	// find its length, as for GatewayOptions
+	MaxSpooledBody int64
+}
+
+// Returned when a script writes more than MaxOutput
+var ErrCGIOutputTooLarge = errors.New("webpipes: CGI output too large")
+
+// Wraps the error when a script cannot be started
+var errCGIStart = errors.New("webpipes: cannot run CGI script")
+
+// Serve the CGI script 'path', with 'prefix' stripped from the URL being
+// requested to give the PATH_INFO of the script, configured with 'opts'.
+// Since the script must be told the length of the request body, a body of
+// unknown length is read in full before the script is started, up to
+// MaxSpooledBody. A script that cannot be started is answered with a 500.
+func NewCGIServer(path, prefix string, opts CGIOptions) Source {
+	if opts.Dir == "" {
+		opts.Dir = filepath.Dir(path)
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = log.Default()
+	}
+	if opts.MaxSpooledBody == 0 {
+		opts.MaxSpooledBody = defaultMaxSpooledBody
+	}
+	root := prefix
+	if root == "" {
+		root = "/"
+	}
+	var slots chan struct{}
+	if opts.MaxConcurrent > 0 {
+		slots = make(chan struct{}, opts.MaxConcurrent)
+	}
+
+	return func(conn *Conn, req *http.Request, writer io.WriteCloser) bool {
+		if err := spoolRequest(conn, req, opts.MaxSpooledBody); err != nil {
+			writer.Close()
+			log.Printf("webpipes: cannot read request body for %s: %s", req.URL, err)
+			conn.HTTPStatusResponse(errorStatus(err))
+			return true
+		}
+
+		pathInfo := req.URL.Path
+		if root != "/" {
+			pathInfo = strings.TrimPrefix(pathInfo, root)
+		}
+		env := newCGIEnv(conn, req, root, pathInfo, path)
+		if searchPath := os.Getenv("PATH"); searchPath != "" {
+			env.set("PATH", searchPath)
+		} else {
+			env.set("PATH", cgiDefaultPath)
+		}
+		for _, name := range append(cgiInheritEnv, opts.InheritEnv...) {
+			if value := os.Getenv(name); value != "" {
+				env.set(name, value)
+			}
+		}
+		env.setAll(opts.Env)
+
+		resp, err := gatewayHeader(conn, opts.Timeout, func(ctx context.Context) (*gatewayResponse, error) {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return nil, context.Cause(ctx)
+				}
+			}
+			return startCGI(conn, req, path, env, &opts, slots)
+		})
+		if err != nil {
+			writer.Close()
+			if errors.Is(err, errCGIStart) {
+				log.Print(err)
+				conn.HTTPStatusResponse(http.StatusInternalServerError)
+			} else {
+				proxyError(conn, req, err)
+			}
+			return true
+		}
+		gatewayBody(conn, resp, writer)
+		return true
+	}
+}
+
+// Start the script for a request. Once it has exited its slot is released.
+func startCGI(conn *Conn, req *http.Request, path string, env cgiEnv, opts *CGIOptions, slots chan struct{}) (*gatewayResponse, error) {
+	release := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+
+	cmd := exec.Command(path, opts.Args...)
+	cmd.Dir = opts.Dir
+	for _, v := range env {
+		cmd.Env = append(cmd.Env, v.name+"="+v.value)
+	}
+	if req.ContentLength > 0 {
+		cmd.Stdin = io.LimitReader(req.Body, req.ContentLength)
+	}
+	cmd.Stderr = &stderrWriter{opts.Stderr, "cgi " + filepath.Base(path)}
+	// Don't wait forever for anything the script has started that is still
+	// holding its standard error open
+	cmd.WaitDelay = time.Second
+	setProcessGroup(cmd)
+
+	// The output is read directly rather than by way of exec, so that it can
+	// carry on being read while the script is waited for
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("%w %s: %s", errCGIStart, path, err)
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdout.Close()
+		release()
+		return nil, fmt.Errorf("%w %s: %s", errCGIStart, path, err)
+	}
+
+	var mu sync.Mutex
+	exited := false
+	kill := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !exited {
+			killProcessGroup(cmd)
+		}
+	}
+	var timer *time.Timer
+	if opts.Timeout > 0 {
+		timer = time.AfterFunc(opts.Timeout, kill)
+	}
+	go func() {
+		err := cmd.Wait()
+		mu.Lock()
+		exited = true
+		mu.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		release()
+		if err != nil && conn.Context().Err() == nil {
+			log.Printf("webpipes: CGI script %s: %s", path, err)
+		}
+	}()
+
+	// Once the script has closed its output it is left to finish, but if
+	// the request ends before then it is killed
+	output := &cgiOutput{r: stdout, max: opts.MaxOutput, kill: kill}
+	var once sync.Once
+	abort := func() {
+		once.Do(func() {
+			if !output.eof.Load() {
+				kill()
+			}
+			stdout.Close()
+		})
+	}
+	return &gatewayResponse{bufio.NewReader(output), abort}, nil
+}
+
+// The output of a script, which is killed if it writes too much
+type cgiOutput struct {
+	r    io.Reader
+	max  int64
+	read int64
+	kill func()
+	eof  atomic.Bool
+}
+
+func (co *cgiOutput) Read(p []byte) (int, error) {
+	n, err := co.r.Read(p)
+	co.read += int64(n)
+	if co.max > 0 && co.read > co.max {
+		co.kill()
+		return 0, ErrCGIOutputTooLarge
+	}
+	if err == io.EOF {
+		co.eof.Store(true)
+	}
+	return n, err
+}
+
+// Logs what a script writes to its error stream
+type stderrWriter struct {
+	logger *log.Logger
+	name   string
+}
+
+func (sw *stderrWriter) Write(p []byte) (int, error) {
+	logStderr(sw.logger, sw.name, p)
+	return len(p), nil
+}
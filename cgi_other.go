@@ -0,0 +1,21 @@
+//go:build !unix
+
+package webpipes
+
+import "os/exec"
+
+// The search path given to CGI scripts when the server has none
+const cgiDefaultPath = ""
+
+// The variables always passed on to CGI scripts, which Windows needs to run
+// programs
+var cgiInheritEnv = []string{"SystemRoot", "COMSPEC", "PATHEXT", "WINDIR"}
+
+// Process groups are not available, so only the command itself is stopped
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// Kill the command
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,315 @@
+//go:build unix
+
+package webpipes
+
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "log"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "syscall"
+import "testing"
+import "time"
+
+// Write a shell script running 'body', returning its path
+func writeScript(t *testing.T, name, body string) string {
+	script := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+// Run a request for 'path' through a CGI server for 'script'
+func cgiRequest(script, path string, opts CGIOptions) *httptest.ResponseRecorder {
+	chain := Chain(NewCGIServer(script, "/", opts), OutputPipe)
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+// A buffer that can be logged to while it is being read
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+// Wait for 'want' to be written to the buffer
+func (lb *lockedBuffer) wait(t *testing.T, want string) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		lb.mu.Lock()
+		found := strings.Contains(lb.buf.String(), want)
+		lb.mu.Unlock()
+		if found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	t.Errorf("%q not logged, got %q", want, lb.buf.String())
+}
+
+// Capture what is written to the standard logger
+func captureLog(t *testing.T) *lockedBuffer {
+	lb := new(lockedBuffer)
+	log.SetOutput(lb)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return lb
+}
+
+// Wait for the process whose pid is written in 'pidFile' to go away. A
+// process that has exited but not been reaped counts as gone.
+func checkProcessGone(t *testing.T, pidFile string) {
+	t.Helper()
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			return
+		}
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err == nil && strings.Contains(string(stat), ") Z ") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+	t.Errorf("child process %d still running", pid)
+}
+
+func TestCGITimeout(t *testing.T) {
+	// The scripts leave a child running, which has to be killed with them
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"before headers", "", http.StatusGatewayTimeout},
+		{"after headers", "echo Content-Type: text/plain\necho\necho started\n", http.StatusOK},
+	}
+	for _, test := range tests {
+		pidFile := filepath.Join(t.TempDir(), "pid")
+		script := writeScript(t, "sleep.sh", test.header+
+			"sleep 30 &\n"+
+			"echo $! > \"$PID_FILE\"\n"+
+			"sleep 30\n")
+		opts := CGIOptions{
+			Timeout: 200 * time.Millisecond,
+			Env:     []string{"PID_FILE=" + pidFile},
+		}
+
+		start := time.Now()
+		rec := cgiRequest(script, "/", opts)
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: took %s", test.name, elapsed)
+		}
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, rec.Code, test.status)
+		}
+		if test.status == http.StatusOK && rec.Body.String() != "started\n" {
+			t.Errorf("%s: body %q", test.name, rec.Body)
+		}
+		checkProcessGone(t, pidFile)
+	}
+}
+
+func TestCGIMaxOutput(t *testing.T) {
+	logged := captureLog(t)
+	line := strings.Repeat("x", 99)
+	script := writeScript(t, "flood.sh", "echo Content-Type: text/plain\n"+
+		"echo\n"+
+		"while :; do echo "+line+"; done\n")
+
+	rec := cgiRequest(script, "/", CGIOptions{MaxOutput: 64 << 10})
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", rec.Code)
+	}
+	if n := rec.Body.Len(); n == 0 || n > 64<<10 {
+		t.Errorf("%d bytes of output, want at most %d", n, 64<<10)
+	}
+	logged.wait(t, ErrCGIOutputTooLarge.Error())
+
+	// Too much output before the headers are done
+	script = writeScript(t, "headers.sh", "while :; do echo X-Junk: "+line+"; done\n")
+	if rec := cgiRequest(script, "/", CGIOptions{MaxOutput: 1000}); rec.Code != http.StatusBadGateway {
+		t.Errorf("header flood: status %d, want 502", rec.Code)
+	}
+}
+
+func TestCGIOutputLimit(t *testing.T) {
+	killed := 0
+	co := &cgiOutput{r: strings.NewReader(strings.Repeat("x", 100)), max: 50, kill: func() { killed++ }}
+	_, err := io.ReadAll(co)
+	if !errors.Is(err, ErrCGIOutputTooLarge) || killed != 1 {
+		t.Errorf("error %v, killed %d times", err, killed)
+	}
+
+	co = &cgiOutput{r: strings.NewReader(strings.Repeat("x", 100)), max: 100, kill: func() { killed++ }}
+	data, err := io.ReadAll(co)
+	if err != nil || len(data) != 100 || !co.eof.Load() {
+		t.Errorf("read %d bytes, error %v", len(data), err)
+	}
+}
+
+func TestCGIEnv(t *testing.T) {
+	t.Setenv("WEBPIPES_SECRET", "secret")
+	t.Setenv("WEBPIPES_SHARED", "shared")
+	script := writeScript(t, "env.sh", "echo Content-Type: text/plain\n"+
+		"echo\n"+
+		"env\n")
+
+	rec := cgiRequest(script, "/path?q=1", CGIOptions{
+		InheritEnv: []string{"WEBPIPES_SHARED"},
+		Env:        []string{"EXTRA=1", "SERVER_SOFTWARE=test"},
+	})
+	env := make(map[string]string)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if name, value, ok := strings.Cut(line, "="); ok {
+			env[name] = value
+		}
+	}
+
+	want := map[string]string{
+		"WEBPIPES_SHARED": "shared",
+		"EXTRA":           "1",
+		"SERVER_SOFTWARE": "test",
+		"PATH_INFO":       "/path",
+		"QUERY_STRING":    "q=1",
+		"REQUEST_METHOD":  "GET",
+	}
+	for name, value := range want {
+		if env[name] != value {
+			t.Errorf("%s=%q, want %q", name, env[name], value)
+		}
+	}
+	if env["PATH"] == "" {
+		t.Errorf("PATH not passed on")
+	}
+	if _, ok := env["WEBPIPES_SECRET"]; ok {
+		t.Errorf("WEBPIPES_SECRET passed on without being inherited")
+	}
+}
+
+func TestCGIDirArgs(t *testing.T) {
+	script := writeScript(t, "pwd.sh", "echo Content-Type: text/plain\n"+
+		"echo\n"+
+		"pwd -P\n"+
+		"for arg in \"$@\"; do echo \"[$arg]\"; done\n")
+	scriptDir, _ := filepath.EvalSymlinks(filepath.Dir(script))
+	dir, _ := filepath.EvalSymlinks(t.TempDir())
+
+	tests := []struct {
+		opts CGIOptions
+		want string
+	}{
+		{CGIOptions{}, scriptDir + "\n"},
+		{CGIOptions{Dir: dir, Args: []string{"a", "b c"}}, dir + "\n[a]\n[b c]\n"},
+	}
+	for _, test := range tests {
+		if rec := cgiRequest(script, "/", test.opts); rec.Body.String() != test.want {
+			t.Errorf("%+v: body %q, want %q", test.opts, rec.Body, test.want)
+		}
+	}
+}
+
+func TestCGIStderr(t *testing.T) {
+	logged := new(lockedBuffer)
+	script := writeScript(t, "stderr.sh", "echo first >&2\n"+
+		"echo second >&2\n"+
+		"echo Content-Type: text/plain\n"+
+		"echo\n"+
+		"echo ok\n")
+
+	rec := cgiRequest(script, "/", CGIOptions{Stderr: log.New(logged, "", 0)})
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body)
+	}
+	logged.wait(t, "cgi stderr.sh: first\ncgi stderr.sh: second\n")
+}
+
+func TestCGIMaxConcurrent(t *testing.T) {
+	// Each copy of the script reports how many are running
+	running := t.TempDir()
+	script := writeScript(t, "count.sh", "touch \"$RUNNING/$$\"\n"+
+		"sleep 0.2\n"+
+		"echo Content-Type: text/plain\n"+
+		"echo\n"+
+		"ls \"$RUNNING\" | wc -l\n"+
+		"rm \"$RUNNING/$$\"\n")
+	opts := CGIOptions{MaxConcurrent: 2, Env: []string{"RUNNING=" + running}}
+	chain := Chain(NewCGIServer(script, "/", opts), OutputPipe)
+
+	var wg sync.WaitGroup
+	counts := make([]int, 6)
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			chain.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			counts[i], _ = strconv.Atoi(strings.TrimSpace(rec.Body.String()))
+		}(i)
+	}
+	wg.Wait()
+	for _, n := range counts {
+		if n < 1 || n > 2 {
+			t.Errorf("%d copies running at once, want at most 2: %v", n, counts)
+			break
+		}
+	}
+
+	// A request that waits too long for its turn times out, while the one
+	// holding the slot finishes in time
+	script = writeScript(t, "slow.sh", "sleep 0.6\n"+
+		"echo Content-Type: text/plain\n"+
+		"echo\n")
+	opts = CGIOptions{MaxConcurrent: 1, Timeout: time.Second}
+	chain = Chain(NewCGIServer(script, "/", opts), OutputPipe)
+	statuses := make([]int, 2)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			chain.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			statuses[i] = rec.Code
+		}(i)
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusGatewayTimeout {
+		t.Errorf("statuses %v, want [200 504]", statuses)
+	}
+}
+
+func TestCGILocalRedirect(t *testing.T) {
+	// As CGIServer did with net/http/cgi, which only redirects internally
+	// when given a handler to do it with, a local path is sent to the client
+	script := writeScript(t, "redirect.sh", "echo Location: /elsewhere\n"+
+		"echo\n")
+	rec := cgiRequest(script, "/", CGIOptions{})
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/elsewhere" {
+		t.Errorf("status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package webpipes
+
+import "os/exec"
+import "syscall"
+
+// The search path given to CGI scripts when the server has none
+const cgiDefaultPath = "/bin:/usr/bin:/usr/ucb:/usr/bsd:/usr/local/bin"
+
+// The variables always passed on to CGI scripts, which the dynamic linker
+// needs to find shared libraries
+var cgiInheritEnv = []string{"LD_LIBRARY_PATH", "DYLD_LIBRARY_PATH", "SHLIB_PATH"}
+
+// Start the command in a process group of its own
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill the command and everything else in its process group
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
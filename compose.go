@@ -0,0 +1,65 @@
+package webpipes
+
+import "net/http"
+import "net/url"
+import "strings"
+
+//////////////////////////////////////////////////////////////////////////////
+// Conditional composition for chains
+//
+// A chain runs every one of its components for every connection. These
+// combinators wrap components so that they only run for some connections,
+// which lets a single chain do the work that would otherwise need several
+// chains behind an http.ServeMux. Since chains are components themselves,
+// the branches can be whole chains.
+
+// Run 'then' for connections that match 'pred' and 'otherwise' for those that
+// do not. Either may be nil, in which case the connection is passed on.
+func If(pred Predicate, then, otherwise Component) Component {
+	return ConnFunc(func(conn *Conn, req *http.Request) error {
+		branch := otherwise
+		if pred(conn, req) {
+			branch = then
+		}
+		if branch == nil {
+			return nil
+		}
+		return callComponent(branch, conn, req)
+	})
+}
+
+// Run the component from 'cases' that is named by 'selector'. If there is no
+// such case, the component for the empty string is run instead, and if there
+// is none of those either the connection is passed on.
+func Switch(selector func(*Conn, *http.Request) string, cases map[string]Component) Component {
+	return ConnFunc(func(conn *Conn, req *http.Request) error {
+		branch, ok := cases[selector(conn, req)]
+		if !ok {
+			branch = cases[""]
+		}
+		if branch == nil {
+			return nil
+		}
+		return callComponent(branch, conn, req)
+	})
+}
+
+// Run 'comp' for requests for 'prefix' or anything below it, with the prefix
+// stripped from the path of the request that it sees, in the same way as
+// http.StripPrefix. Other requests are passed on.
+func Mount(prefix string, comp Component) Component {
+	return ConnFunc(func(conn *Conn, req *http.Request) error {
+		path := strings.TrimPrefix(req.URL.Path, prefix)
+		if len(path) == len(req.URL.Path) {
+			return nil
+		}
+
+		mounted := new(http.Request)
+		*mounted = *req
+		mounted.URL = new(url.URL)
+		*mounted.URL = *req.URL
+		mounted.URL.Path = path
+		mounted.URL.RawPath = ""
+		return callComponent(comp, conn, mounted)
+	})
+}
@@ -0,0 +1,69 @@
+package webpipes
+
+import "net/http"
+import "net/http/httptest"
+import "testing"
+import "time"
+
+// A component that panics, either directly or in a content goroutine
+type panicComponent struct {
+	name    string
+	content bool
+}
+
+func (pc *panicComponent) String() string {
+	return pc.name
+}
+
+func (pc *panicComponent) HandleHTTPRequest(conn *Conn, req *http.Request) bool {
+	if !pc.content {
+		panic("boom")
+	}
+	writer := conn.NewContentWriter()
+	conn.Go(func() {
+		defer writer.Close()
+		panic("boom")
+	})
+	return true
+}
+
+// Check that panics inside combinators are charged to the component inside
+func TestCombinatorPanicAttribution(t *testing.T) {
+	always := func(*Conn, *http.Request) bool { return true }
+	tests := []struct {
+		name string
+		wrap func(Component) Component
+	}{
+		{"mount", func(c Component) Component { return Mount("/m", c) }},
+		{"if", func(c Component) Component { return If(always, c, nil) }},
+		{"switch", func(c Component) Component {
+			return Switch(func(*Conn, *http.Request) string { return "" }, map[string]Component{"": c})
+		}},
+	}
+
+	for _, test := range tests {
+		for _, content := range []bool{false, true} {
+			name := test.name + "-panicker"
+			if content {
+				name += "-content"
+			}
+			before := PanicCounts()[name]
+
+			chain := Chain(test.wrap(&panicComponent{name, content}), OutputPipe)
+			rec := httptest.NewRecorder()
+			chain.ServeHTTP(rec, httptest.NewRequest("GET", "/m/x", nil))
+			if !content && rec.Code != http.StatusInternalServerError {
+				t.Errorf("%s: status %d, want 500", name, rec.Code)
+			}
+
+			// Content goroutines may be counted after the response
+			deadline := time.Now().Add(time.Second)
+			for PanicCounts()[name] == before && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := PanicCounts()[name]; got != before+1 {
+				t.Errorf("%s: %d panics counted, want %d", name, got, before+1)
+			}
+		}
+	}
+}
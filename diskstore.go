@@ -0,0 +1,431 @@
+package webpipes
+
+import "container/list"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "hash"
+import "io"
+import "log"
+import "os"
+import "path/filepath"
+import "runtime"
+import "sync"
+import "time"
+
+//////////////////////////////////////////////////////////////////////////////
+// Disk storage
+//
+// A DiskStore keeps each body in a file named after the SHA-256 of its
+// content, so identical bodies stored under different keys share a file, and
+// keeps the responses themselves in an index file. The directory looks like:
+//
+//   index.json        the stored responses, least recently used first
+//   objects/ab/abcd…  the bodies
+//   tmp/              bodies that are still being written
+//
+// Bodies are written to tmp/ and synced before being renamed into place, and
+// the index is replaced the same way, with the directory synced after each
+// rename, so a crash leaves either the old or the new version of each. So
+// that storing a response doesn't wait for the whole index to be rewritten,
+// the index is written in the background a short while after it changes, and
+// a crash can lose the last of the changes. That leaves the index and the
+// bodies out of step, which is put right when the store is next opened:
+// anything left in tmp/ is removed, responses whose body has gone missing are
+// dropped from the index, and bodies that no response refers to are deleted.
+
+// A CacheStore that keeps responses in a directory
+type DiskStore struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	refs    map[string]int
+
+	// Set when the index has changed since it was last written, and the
+	// timer that will write it
+	dirty  bool
+	saving *time.Timer
+
+	// Held while the index file is written
+	saveMu sync.Mutex
+}
+
+// How long after a change the index is written, so that a burst of changes
+// is written together
+const diskIndexDelay = time.Second
+
+// A response in the index, along with the body it refers to
+type diskRecord struct {
+	CachedResponse
+	Object string
+	Used   time.Time
+}
+
+// The contents of index.json
+type diskIndex struct {
+	Version int
+	Entries []*diskRecord
+}
+
+// Open the store in 'dir', creating it if necessary, which holds up to
+// 'maxBytes' bytes of bodies
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	ds := &DiskStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		refs:     make(map[string]int),
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"objects", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	ds.mu.Lock()
+	err := ds.recover()
+	for err == nil && ds.size > ds.maxBytes {
+		ds.remove(ds.lru.Back())
+	}
+	ds.dirty = true
+	ds.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return ds, ds.writeIndex()
+}
+
+// Load the index and make it agree with the bodies on disk. The mutex must be
+// held.
+func (ds *DiskStore) recover() error {
+	var index diskIndex
+	data, err := os.ReadFile(filepath.Join(ds.dir, "index.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			log.Printf("webpipes: discarding unreadable cache index in %s: %s", ds.dir, err)
+			index.Entries = nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, record := range index.Entries {
+		if record == nil || record.Key == "" || !validObject(record.Object) {
+			continue
+		}
+		info, err := os.Stat(ds.objectPath(record.Object))
+		if err != nil || info.Size() != record.Size {
+			continue
+		}
+		if elem := ds.entries[record.Key]; elem != nil {
+			ds.remove(elem)
+		}
+		ds.add(record)
+	}
+
+	// Remove the bodies that nothing refers to, which are left behind if
+	// the store stops between storing a body and saving the index
+	return filepath.Walk(filepath.Join(ds.dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if ds.refs[info.Name()] == 0 {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// Check that the name of a body is a hash, and so safe to use as a file name
+func validObject(object string) bool {
+	sum, err := hex.DecodeString(object)
+	return err == nil && len(sum) == sha256.Size
+}
+
+// Return the path of the file holding the body with the given hash
+func (ds *DiskStore) objectPath(object string) string {
+	return filepath.Join(ds.dir, "objects", object[:2], object)
+}
+
+func (ds *DiskStore) Get(key string) (*CachedResponse, io.ReadCloser) {
+	ds.mu.Lock()
+	elem := ds.entries[key]
+	if elem == nil {
+		ds.mu.Unlock()
+		return nil, nil
+	}
+	ds.lru.MoveToFront(elem)
+	record := elem.Value.(*diskRecord)
+	record.Used = time.Now()
+	ds.mu.Unlock()
+
+	// Once open, the file can still be read even if it is removed
+	file, err := os.Open(ds.objectPath(record.Object))
+	if err != nil {
+		log.Printf("webpipes: cache body for %q has gone: %s", key, err)
+		ds.mu.Lock()
+		// The response may have been replaced in the meantime
+		if ds.entries[key] == elem {
+			ds.remove(elem)
+			ds.changed()
+		}
+		ds.mu.Unlock()
+		return nil, nil
+	}
+	return &record.CachedResponse, file
+}
+
+func (ds *DiskStore) Create() (CacheWriter, error) {
+	file, err := os.CreateTemp(filepath.Join(ds.dir, "tmp"), "body-")
+	if err != nil {
+		return nil, err
+	}
+	return &diskWriter{store: ds, file: file, digest: sha256.New()}, nil
+}
+
+func (ds *DiskStore) Delete(key string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if elem := ds.entries[key]; elem != nil {
+		ds.remove(elem)
+		ds.changed()
+	}
+}
+
+func (ds *DiskStore) Size() int64 {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.size
+}
+
+// Write the index to disk straight away, including the order in which
+// responses have been used, which is otherwise only written along with other
+// changes. This should be called before shutting down.
+func (ds *DiskStore) Flush() error {
+	ds.mu.Lock()
+	ds.dirty = true
+	if ds.saving != nil {
+		ds.saving.Stop()
+		ds.saving = nil
+	}
+	ds.mu.Unlock()
+	return ds.writeIndex()
+}
+
+// Add a record to the index. The mutex must be held.
+func (ds *DiskStore) add(record *diskRecord) {
+	ds.entries[record.Key] = ds.lru.PushFront(record)
+	if ds.refs[record.Object] == 0 {
+		ds.size += record.Size
+	}
+	ds.refs[record.Object]++
+}
+
+// Remove a record from the index, and its body if nothing else refers to it.
+// The mutex must be held.
+func (ds *DiskStore) remove(elem *list.Element) {
+	record := ds.lru.Remove(elem).(*diskRecord)
+	if ds.entries[record.Key] == elem {
+		delete(ds.entries, record.Key)
+	}
+
+	ds.refs[record.Object]--
+	if ds.refs[record.Object] > 0 {
+		return
+	}
+	delete(ds.refs, record.Object)
+	ds.size -= record.Size
+	if err := os.Remove(ds.objectPath(record.Object)); err != nil && !os.IsNotExist(err) {
+		log.Printf("webpipes: cannot remove cache body: %s", err)
+	}
+}
+
+// Note that the index has changed, and arrange for it to be written. The
+// mutex must be held.
+func (ds *DiskStore) changed() {
+	ds.dirty = true
+	if ds.saving == nil {
+		ds.saving = time.AfterFunc(diskIndexDelay, func() {
+			ds.mu.Lock()
+			ds.saving = nil
+			ds.mu.Unlock()
+			if err := ds.writeIndex(); err != nil {
+				log.Printf("webpipes: cannot save cache index in %s: %s", ds.dir, err)
+			}
+		})
+	}
+}
+
+// Replace the index file if it has changed. The index is encoded with the
+// mutex held, but written without it.
+func (ds *DiskStore) writeIndex() error {
+	ds.saveMu.Lock()
+	defer ds.saveMu.Unlock()
+
+	ds.mu.Lock()
+	if !ds.dirty {
+		ds.mu.Unlock()
+		return nil
+	}
+	index := diskIndex{Version: 1}
+	for elem := ds.lru.Back(); elem != nil; elem = elem.Prev() {
+		index.Entries = append(index.Entries, elem.Value.(*diskRecord))
+	}
+	data, err := json.Marshal(index)
+	ds.dirty = false
+	ds.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(ds.dir, "index.json"), data)
+	}
+	if err != nil {
+		ds.mu.Lock()
+		ds.dirty = true
+		ds.mu.Unlock()
+	}
+	return err
+}
+
+// Sync the directory 'dir', so that files renamed into it stay renamed after
+// a crash. Windows doesn't allow directories to be synced, and records
+// renames in its journal instead.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Write 'data' to a temporary file and rename it over 'path', so that readers
+// see either the old or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+type diskWriter struct {
+	store  *DiskStore
+	file   *os.File
+	digest hash.Hash
+	size   int64
+}
+
+func (dw *diskWriter) Write(p []byte) (int, error) {
+	if dw.size+int64(len(p)) > dw.store.maxBytes {
+		return 0, ErrCacheEntryTooLarge
+	}
+	n, err := dw.file.Write(p)
+	dw.digest.Write(p[:n])
+	dw.size += int64(n)
+	return n, err
+}
+
+func (dw *diskWriter) Commit(resp *CachedResponse) (err error) {
+	err = dw.file.Sync()
+	if closeErr := dw.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dw.file.Name())
+		return err
+	}
+
+	resp.Size = dw.size
+	record := &diskRecord{
+		CachedResponse: *resp,
+		Object:         hex.EncodeToString(dw.digest.Sum(nil)),
+		Used:           time.Now(),
+	}
+
+	// The directory for the body, and the directory holding that if it has
+	// to be created, must be synced for the rename to last. That is done
+	// once the mutex is released, since if it is lost the body is only
+	// found to be missing when the store is next opened.
+	var dirs []string
+	defer func() {
+		for _, dir := range dirs {
+			if err == nil {
+				err = syncDir(dir)
+			}
+		}
+	}()
+
+	ds := dw.store
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	path := ds.objectPath(record.Object)
+	if ds.refs[record.Object] > 0 {
+		// The same body is already stored
+		os.Remove(dw.file.Name())
+	} else {
+		dir := filepath.Dir(path)
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			dirs = append(dirs, filepath.Dir(dir))
+		} else if os.IsExist(err) {
+			err = nil
+		}
+		if err == nil {
+			err = os.Rename(dw.file.Name(), path)
+		}
+		if err != nil {
+			os.Remove(dw.file.Name())
+			return err
+		}
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	// Add the new record before removing the one it replaces, which may
+	// refer to the same body
+	old := ds.entries[record.Key]
+	ds.add(record)
+	if old != nil {
+		ds.remove(old)
+	}
+	for ds.size > ds.maxBytes {
+		ds.remove(ds.lru.Back())
+	}
+	ds.changed()
+	return nil
+}
+
+func (dw *diskWriter) Abort() {
+	dw.file.Close()
+	os.Remove(dw.file.Name())
+}
@@ -0,0 +1,275 @@
+package webpipes
+
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// Return the names of the files below 'dir' in the store at 'root'
+func storeFiles(t *testing.T, root, dir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.Walk(filepath.Join(root, dir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			names = append(names, info.Name())
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func openDiskStore(t *testing.T, dir string, maxBytes int64) *DiskStore {
+	t.Helper()
+	ds, err := NewDiskStore(dir, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ds.Flush() })
+	return ds
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	ds := openDiskStore(t, dir, 1<<20)
+	putCached(t, ds, "a", "first body")
+	putCached(t, ds, "b", "second body")
+
+	if got := getCached(ds, "a"); got != "first body" {
+		t.Errorf("a: %q", got)
+	}
+	if size := ds.Size(); size != 21 {
+		t.Errorf("size %d, want 21", size)
+	}
+	if files := storeFiles(t, dir, "tmp"); len(files) != 0 {
+		t.Errorf("left in tmp: %v", files)
+	}
+
+	// Replacing a response removes its old body
+	putCached(t, ds, "a", "new body")
+	if got := getCached(ds, "a"); got != "new body" {
+		t.Errorf("a after replacing: %q", got)
+	}
+	if files := storeFiles(t, dir, "objects"); len(files) != 2 {
+		t.Errorf("%d bodies stored, want 2", len(files))
+	}
+
+	// Everything is still there once the store is reopened
+	if err := ds.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ds = openDiskStore(t, dir, 1<<20)
+	for key, want := range map[string]string{"a": "new body", "b": "second body", "c": "-"} {
+		if got := getCached(ds, key); got != want {
+			t.Errorf("%s after reopening: %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDiskStoreSharedBody(t *testing.T) {
+	dir := t.TempDir()
+	ds := openDiskStore(t, dir, 1<<20)
+	putCached(t, ds, "a", "same body")
+	putCached(t, ds, "b", "same body")
+
+	if files := storeFiles(t, dir, "objects"); len(files) != 1 {
+		t.Errorf("%d bodies stored, want 1", len(files))
+	}
+	if size := ds.Size(); size != 9 {
+		t.Errorf("size %d, want 9", size)
+	}
+
+	ds.Delete("a")
+	if got := getCached(ds, "b"); got != "same body" {
+		t.Errorf("b after removing a: %q", got)
+	}
+
+	// Replacing a response with the body it already has keeps the body
+	putCached(t, ds, "b", "same body")
+	if got := getCached(ds, "b"); got != "same body" {
+		t.Errorf("b after replacing: %q", got)
+	}
+
+	ds.Delete("b")
+	if files := storeFiles(t, dir, "objects"); len(files) != 0 || ds.Size() != 0 {
+		t.Errorf("after removing both: %v, size %d", files, ds.Size())
+	}
+}
+
+func TestDiskStoreEviction(t *testing.T) {
+	dir := t.TempDir()
+	ds := openDiskStore(t, dir, 30)
+	for _, key := range []string{"a", "b", "c"} {
+		putCached(t, ds, key, strings.Repeat(key, 10))
+	}
+	getCached(ds, "a")
+	putCached(t, ds, "d", strings.Repeat("d", 10))
+
+	for key, want := range map[string]string{"a": "aaaaaaaaaa", "b": "-", "c": "cccccccccc", "d": "dddddddddd"} {
+		if got := getCached(ds, key); got != want {
+			t.Errorf("%s: %q, want %q", key, got, want)
+		}
+	}
+	if err := putCached(t, ds, "e", strings.Repeat("e", 31)); err != ErrCacheEntryTooLarge {
+		t.Errorf("storing too much: %v", err)
+	}
+
+	// The order of use survives reopening, with a smaller limit
+	for _, key := range []string{"a", "d", "c"} {
+		getCached(ds, key)
+	}
+	ds.Flush()
+	ds = openDiskStore(t, dir, 20)
+	for key, want := range map[string]string{"a": "-", "c": "cccccccccc", "d": "dddddddddd"} {
+		if got := getCached(ds, key); got != want {
+			t.Errorf("%s after reopening: %q, want %q", key, got, want)
+		}
+	}
+	if files := storeFiles(t, dir, "objects"); len(files) != 2 {
+		t.Errorf("%d bodies left, want 2", len(files))
+	}
+}
+
+func TestDiskStoreRecovery(t *testing.T) {
+	setup := func(t *testing.T) (string, *DiskStore) {
+		dir := t.TempDir()
+		ds := openDiskStore(t, dir, 1<<20)
+		putCached(t, ds, "a", "first body")
+		putCached(t, ds, "b", "second body")
+		if err := ds.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return dir, ds
+	}
+	index := func(dir string) string {
+		return filepath.Join(dir, "index.json")
+	}
+
+	t.Run("corrupt index", func(t *testing.T) {
+		dir, _ := setup(t)
+		os.WriteFile(index(dir), []byte("{not json"), 0644)
+		ds := openDiskStore(t, dir, 1<<20)
+		if got := getCached(ds, "a"); got != "-" || ds.Size() != 0 {
+			t.Errorf("a: %q, size %d", got, ds.Size())
+		}
+		if files := storeFiles(t, dir, "objects"); len(files) != 0 {
+			t.Errorf("bodies left behind: %v", files)
+		}
+	})
+
+	t.Run("missing index", func(t *testing.T) {
+		dir, _ := setup(t)
+		os.Remove(index(dir))
+		ds := openDiskStore(t, dir, 1<<20)
+		if got := getCached(ds, "b"); got != "-" {
+			t.Errorf("b: %q", got)
+		}
+		if files := storeFiles(t, dir, "objects"); len(files) != 0 {
+			t.Errorf("bodies left behind: %v", files)
+		}
+		if _, err := os.Stat(index(dir)); err != nil {
+			t.Errorf("index not written: %s", err)
+		}
+	})
+
+	t.Run("orphans and leftovers", func(t *testing.T) {
+		dir, _ := setup(t)
+		orphan := strings.Repeat("ab", 32)
+		os.MkdirAll(filepath.Join(dir, "objects", "ab"), 0755)
+		os.WriteFile(filepath.Join(dir, "objects", "ab", orphan), []byte("orphan"), 0644)
+		os.WriteFile(filepath.Join(dir, "tmp", "body-123"), []byte("partial"), 0644)
+
+		ds := openDiskStore(t, dir, 1<<20)
+		if got := getCached(ds, "a"); got != "first body" {
+			t.Errorf("a: %q", got)
+		}
+		for _, file := range storeFiles(t, dir, "objects") {
+			if file == orphan {
+				t.Errorf("orphan body not removed")
+			}
+		}
+		if files := storeFiles(t, dir, "tmp"); len(files) != 0 {
+			t.Errorf("left in tmp: %v", files)
+		}
+	})
+
+	t.Run("missing body", func(t *testing.T) {
+		dir, ds := setup(t)
+		elem := ds.entries["a"]
+		os.Remove(ds.objectPath(elem.Value.(*diskRecord).Object))
+
+		reopened := openDiskStore(t, dir, 1<<20)
+		if got := getCached(reopened, "a"); got != "-" {
+			t.Errorf("a: %q", got)
+		}
+		if got := getCached(reopened, "b"); got != "second body" {
+			t.Errorf("b: %q", got)
+		}
+		if size := reopened.Size(); size != 11 {
+			t.Errorf("size %d, want 11", size)
+		}
+
+		// A body that goes missing while the store is open is noticed
+		// when it is read
+		if got := getCached(ds, "a"); got != "-" {
+			t.Errorf("a in the open store: %q", got)
+		}
+		if _, ok := ds.entries["a"]; ok {
+			t.Errorf("record with missing body kept")
+		}
+	})
+}
+
+func TestDiskStoreIndexDelay(t *testing.T) {
+	dir := t.TempDir()
+	ds := openDiskStore(t, dir, 1<<20)
+	indexHas := func(key string) bool {
+		data, _ := os.ReadFile(filepath.Join(dir, "index.json"))
+		return strings.Contains(string(data), `"Key":"`+key+`"`)
+	}
+
+	// Storing a response doesn't wait for the index to be written, but it
+	// is written soon after
+	putCached(t, ds, "a", "body")
+	putCached(t, ds, "b", "body")
+	if indexHas("a") {
+		t.Errorf("index written as the response was stored")
+	}
+	for i := 0; i < 100 && !indexHas("b"); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !indexHas("a") || !indexHas("b") {
+		t.Errorf("index not written after a change")
+	}
+}
+
+func TestCacheDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	store := &countingStore{CacheStore: openDiskStore(t, dir, 1<<20)}
+	cache := NewCacheWithStore(store)
+	calls := new(atomic.Int32)
+	chain := Chain(cache.Lookup(nil), cacheSource(calls, "Cache-Control", "max-age=60"), cache.Store(), OutputPipe)
+
+	checkBody(t, cacheRequest(chain, "GET"), "response 1")
+	store.wait(t, 1)
+	checkBody(t, cacheRequest(chain, "GET"), "response 1")
+	checkBody(t, cacheRequest(chain, "POST"), "response 2")
+	checkBody(t, cacheRequest(chain, "GET"), "response 3")
+	store.wait(t, 2)
+
+	if n := store.creates.Load(); n != 2 {
+		t.Errorf("%d cache writers created, want 2", n)
+	}
+	if files := storeFiles(t, dir, "tmp"); len(files) != 0 {
+		t.Errorf("left in tmp: %v", files)
+	}
+	if files := storeFiles(t, dir, "objects"); len(files) != 1 {
+		t.Errorf("%d bodies stored, want 1", len(files))
+	}
+}
@@ -0,0 +1,100 @@
+package webpipes
+
+import "compress/flate"
+import "compress/gzip"
+import "strings"
+import "sync"
+
+//////////////////////////////////////////////////////////////////////////////
+// Encoding registry
+//
+// Compression pipes choose between the content codings in a registry rather
+// than a fixed set, so that new codecs can be added without changes to this
+// package. Each coding is registered with a factory that creates its filter
+// and the compression level to pass to it. When the client rates two codings
+// equally, the one registered first is preferred.
+//
+// For example, a brotli implementation that provides an io.WriteCloser could
+// be registered with:
+//
+//   webpipes.RegisterEncoding("br", 5, func(level int) webpipes.Filter {
+//   	return webpipes.EncoderFilter("br", func(w io.Writer) (io.WriteCloser, error) {
+//   		return brotli.NewWriterLevel(w, level), nil
+//   	})
+//   })
+
+// Create a filter that encodes content at the given compression level
+type EncoderFactory func(level int) Filter
+
+type encoding struct {
+	name   string
+	filter Filter
+}
+
+type EncodingRegistry struct {
+	mu        sync.RWMutex
+	encodings []encoding
+}
+
+// Create an empty encoding registry
+func NewEncodingRegistry() *EncodingRegistry {
+	return new(EncodingRegistry)
+}
+
+// Register the content coding 'name', replacing any existing registration
+// with the same name.
+func (r *EncodingRegistry) Register(name string, level int, factory EncoderFactory) {
+	enc := encoding{strings.ToLower(name), factory(level)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for idx := range r.encodings {
+		if r.encodings[idx].name == enc.name {
+			r.encodings[idx] = enc
+			return
+		}
+	}
+	r.encodings = append(r.encodings, enc)
+}
+
+// Return the names of the registered content codings, in order of preference
+func (r *EncodingRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, len(r.encodings))
+	for idx, enc := range r.encodings {
+		names[idx] = enc.name
+	}
+	return names
+}
+
+// Return the filter for the content coding 'name', or nil if it has not been
+// registered.
+func (r *EncodingRegistry) Filter(name string) Filter {
+	name = strings.ToLower(name)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, enc := range r.encodings {
+		if enc.name == name {
+			return enc.filter
+		}
+	}
+	return nil
+}
+
+// The registry used by CompressionPipe, containing gzip and deflate
+var DefaultEncodings = newDefaultEncodings()
+
+func newDefaultEncodings() *EncodingRegistry {
+	r := NewEncodingRegistry()
+	r.Register("gzip", gzip.DefaultCompression, GzipEncoder)
+	r.Register("deflate", flate.DefaultCompression, FlateEncoder)
+	return r
+}
+
+// Register a content coding in DefaultEncodings
+func RegisterEncoding(name string, level int, factory EncoderFactory) {
+	DefaultEncodings.Register(name, level, factory)
+}
@@ -0,0 +1,152 @@
+package webpipes
+
+import "bytes"
+import "encoding/json"
+import "html/template"
+import "io"
+import "log"
+import "mime"
+import "net/http"
+import "strconv"
+import "github.com/jnwhiteh/webpipes/negotiate"
+
+//////////////////////////////////////////////////////////////////////////////
+// Error pages
+//
+// Conn.HTTPStatusResponse renders the body of a canned response using an
+// ErrorPages registry. Renderers are registered for a status code and a media
+// type, and the one used for a given response is chosen by matching the
+// Accept header of the request against the registered media types. Renderers
+// registered for a specific status code are considered before those registered
+// for any status, and the first of the best matches is used.
+//
+// A registry can be set on a chain or a network handler with WithErrorPages.
+// Connections that have none use DefaultErrorPages, which serves plain text
+// unless the client prefers HTML or RFC 7807 problem details.
+
+// The details of an error response made available to an ErrorRenderer
+type ErrorInfo struct {
+	Status   int    // The HTTP status code of the response
+	Title    string // A short description of the status code
+	Instance string // The request URI that the response is for
+}
+
+// Write the body of an error response to 'w'
+type ErrorRenderer func(w io.Writer, info *ErrorInfo) error
+
+type errorPage struct {
+	contentType string
+	mediaType   string
+	render      ErrorRenderer
+}
+
+type ErrorPages struct {
+	pages map[int][]errorPage
+}
+
+// Create an empty error page registry
+func NewErrorPages() *ErrorPages {
+	return &ErrorPages{pages: make(map[int][]errorPage)}
+}
+
+// Register 'render' as the renderer for responses with the given status code
+// to clients that accept 'contentType'. A status of 0 registers the renderer
+// for every status code. The content type is sent with the response as given,
+// so it may include parameters such as a charset.
+func (ep *ErrorPages) Handle(status int, contentType string, render ErrorRenderer) *ErrorPages {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		panic("webpipes: invalid error page content type " + contentType)
+	}
+	ep.pages[status] = append(ep.pages[status], errorPage{contentType, mediaType, render})
+	return ep
+}
+
+// Pick the renderer for 'status' that best suits 'req', returning nil if
+// there are no renderers registered that could be used.
+func (ep *ErrorPages) lookup(req *http.Request, status int) *errorPage {
+	var candidates []errorPage
+	candidates = append(candidates, ep.pages[status]...)
+	candidates = append(candidates, ep.pages[0]...)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	offers := make([]string, len(candidates))
+	for idx, page := range candidates {
+		offers[idx] = page.mediaType
+	}
+	choice := negotiate.MediaType(req.Header, offers...)
+
+	for idx, page := range candidates {
+		if page.mediaType == choice {
+			return &candidates[idx]
+		}
+	}
+
+	// A client that accepts none of our error pages still needs to be told
+	// what went wrong, so fall back to the first choice.
+	return &candidates[0]
+}
+
+// Render the body of an error response for 'status', returning the content
+// type and the body.
+func (ep *ErrorPages) render(req *http.Request, status int) (string, []byte) {
+	statusText := http.StatusText(status)
+	if statusText == "" {
+		statusText = "status code " + strconv.Itoa(status)
+	}
+	info := &ErrorInfo{status, statusText, req.URL.RequestURI()}
+
+	if page := ep.lookup(req, status); page != nil {
+		buf := new(bytes.Buffer)
+		err := page.render(buf, info)
+		if err == nil {
+			return page.contentType, buf.Bytes()
+		}
+		log.Printf("webpipes: error rendering %s error page: %s", page.contentType, err)
+	}
+
+	buf := new(bytes.Buffer)
+	PlainTextErrorRenderer(buf, info)
+	return "text/plain; charset=utf-8", buf.Bytes()
+}
+
+// Render the status code and description as plain text
+func PlainTextErrorRenderer(w io.Writer, info *ErrorInfo) error {
+	_, err := io.WriteString(w, info.Title+"\n")
+	return err
+}
+
+// Render an RFC 7807 problem details object
+func ProblemJSONErrorRenderer(w io.Writer, info *ErrorInfo) error {
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":     "about:blank",
+		"title":    info.Title,
+		"status":   info.Status,
+		"instance": info.Instance,
+	})
+}
+
+// Render the error using an HTML template, which is executed with the
+// ErrorInfo as its data.
+func HTMLErrorRenderer(tmpl *template.Template) ErrorRenderer {
+	return func(w io.Writer, info *ErrorInfo) error {
+		return tmpl.Execute(w, info)
+	}
+}
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+</body>
+</html>
+`))
+
+// The error pages used by connections that have not been given any others
+var DefaultErrorPages = NewErrorPages().
+	Handle(0, "text/plain; charset=utf-8", PlainTextErrorRenderer).
+	Handle(0, "text/html; charset=utf-8", HTMLErrorRenderer(defaultErrorTemplate)).
+	Handle(0, "application/problem+json", ProblemJSONErrorRenderer)
@@ -0,0 +1,139 @@
+package webpipes
+
+import "bytes"
+import "crypto/sha256"
+import "encoding/hex"
+import "hash"
+import "io"
+import "net/http"
+
+//////////////////////////////////////////////////////////////////////////////
+// Entity tag generation
+//
+// Sources such as TextStringSource and CGI scripts do not provide validators,
+// so ETagFilter derives one from the content itself. A strong entity tag
+// promises that the bytes sent are exactly the ones that were hashed, so if a
+// later component changes the content the tag is downgraded to a weak one,
+// which only promises that the content is equivalent.
+
+// This component sets an ETag for successful responses that do not already
+// have one, using the options in DefaultETagOptions. See NewETagFilter.
+var ETagFilter Pipe = NewETagFilter(DefaultETagOptions)
+
+// Options for an ETag filter
+type ETagOptions struct {
+	// Content of up to this many bytes is read in full and hashed before
+	// the response is sent
+	MaxBuffer int64
+
+	// If set, larger content is hashed as it is sent and the ETag is
+	// delivered as a trailer, otherwise it is sent without an ETag
+	Trailer bool
+}
+
+// The options used by ETagFilter
+var DefaultETagOptions = ETagOptions{
+	MaxBuffer: 1 << 20,
+}
+
+// Create a pipe that sets a strong ETag, computed by hashing the content, on
+// 200 responses that do not have one. If a later component changes the
+// content the ETag is made weak, and if the request turns out to be an error
+// it is removed. Once the ETag is known, the preconditions of the request are
+// evaluated as ConditionalPipe does, so a matching If-None-Match is answered
+// with 304 Not Modified without sending the content.
+//
+// The ETag of content that is delivered in a trailer cannot be known in time
+// to answer preconditions, and clients and caches are free to ignore it.
+func NewETagFilter(opts ETagOptions) Pipe {
+	return func(conn *Conn, req *http.Request) bool {
+		if conn.status != http.StatusOK || conn.GetHeader("ETag") != "" {
+			return true
+		}
+		reader := conn.NewContentReader()
+		if reader == nil {
+			return true
+		}
+
+		digest := sha256.New()
+		data, complete := readAhead(io.TeeReader(reader, digest), opts.MaxBuffer)
+		if complete {
+			// The whole of the content has been read and can be put back
+			reader.Close()
+			conn.body = io.NopCloser(bytes.NewReader(data))
+			etag := formatETag(digest)
+			conn.SetHeader("ETag", etag)
+			conn.BeforeOutput(checkETag(conn, req, etag, conn.Representation()))
+			return true
+		}
+
+		if int64(len(data)) <= opts.MaxBuffer || !opts.Trailer {
+			// The content could not be read, or is too large to hash
+			// before it is sent
+			conn.body = &prefixReader{io.MultiReader(bytes.NewReader(data), reader), reader}
+			return true
+		}
+
+		// Carry on hashing the content as it is sent, and add the ETag once it
+		// is complete
+		representation := conn.Representation()
+		changed, failed := false, false
+		conn.BeforeOutput(func() {
+			changed = conn.Representation() != representation
+			failed = conn.status != http.StatusOK
+		})
+
+		var etag string
+		writer := conn.NewContentWriter()
+		conn.Go(func() {
+			rest := io.MultiReader(bytes.NewReader(data), io.TeeReader(reader, digest))
+			if _, err := io.Copy(writer, rest); err == nil {
+				etag = formatETag(digest)
+			}
+			reader.Close()
+			writer.Close()
+		})
+		conn.Trailer("ETag", func() string {
+			if failed || etag == "" {
+				return ""
+			}
+			if changed {
+				return "W/" + etag
+			}
+			return etag
+		})
+		return true
+	}
+}
+
+// Quote the sum of 'digest' as a strong entity tag
+func formatETag(digest hash.Hash) string {
+	return `"` + hex.EncodeToString(digest.Sum(nil)[:16]) + `"`
+}
+
+// Return a function to run before output that weakens or removes the ETag
+// set by the filter as necessary, and then evaluates the preconditions of
+// the request
+func checkETag(conn *Conn, req *http.Request, etag string, representation int) func() {
+	return func() {
+		if conn.GetHeader("ETag") != etag || conn.status == http.StatusNotModified {
+			// Another component has taken care of it
+			return
+		}
+		if conn.status < 200 || conn.status > 299 {
+			conn.DelHeader("ETag")
+			return
+		}
+		if conn.Representation() != representation {
+			conn.SetHeader("ETag", "W/"+etag)
+		}
+
+		switch checkPreconditions(conn, req) {
+		case http.StatusNotModified:
+			notModified(conn)
+		case http.StatusPreconditionFailed:
+			conn.HTTPStatusResponse(http.StatusPreconditionFailed)
+			conn.DelHeader("ETag")
+		}
+	}
+}
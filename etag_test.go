@@ -0,0 +1,55 @@
+package webpipes
+
+import "io"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+func TestETagFilter(t *testing.T) {
+	small := Chain(TextStringSource("hello"), ETagFilter, OutputPipe)
+
+	rec := httptest.NewRecorder()
+	small.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	etag := rec.Header().Get("ETag")
+	if etag == "" || rec.Body.String() != "hello" {
+		t.Fatalf("ETag %q, body %q", etag, rec.Body)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	small.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("If-None-Match: status %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+}
+
+func TestETagFilterLargeContent(t *testing.T) {
+	text := strings.Repeat("x", 100)
+	for _, trailer := range []bool{false, true} {
+		filter := NewETagFilter(ETagOptions{MaxBuffer: 10, Trailer: trailer})
+		srv := httptest.NewServer(Chain(TextStringSource(text), filter, OutputPipe))
+
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Te", "trailers")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The trailer is only available once the body has been read
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+
+		if string(body) != text {
+			t.Errorf("trailer %v: body differs", trailer)
+		}
+		if got := resp.Header.Get("ETag"); got != "" {
+			t.Errorf("trailer %v: ETag header %q for content over MaxBuffer", trailer, got)
+		}
+		if got := resp.Trailer.Get("ETag"); (got != "") != trailer {
+			t.Errorf("trailer %v: ETag trailer %q", trailer, got)
+		}
+	}
+}
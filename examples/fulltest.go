@@ -7,6 +7,7 @@ import "log"
 import "os"
 import "path"
 import "runtime"
+import "time"
 import "github.com/jnwhiteh/webpipes"
 
 var helloworld string = "Hello, world!\n"
@@ -84,6 +85,22 @@ func main() {
 		webpipes.OutputPipe,
 	))
 
+	// A single process network for a whole site, routing requests for
+	// /hello to a branch of their own and merging the branches back
+	// together for output
+	hello := webpipes.ProcNetwork(webpipes.TextStringSource(helloworld))
+	site := webpipes.ProcNetwork(
+		webpipes.Router(webpipes.Route{
+			Match: webpipes.PathPrefix("/webpipe/routed/hello"),
+			To:    hello.In,
+		}),
+		webpipes.FileServer("../http-data", "/webpipe/routed"),
+	)
+	output := webpipes.ProcNetworkInOut(webpipes.Merge(site.Out, hello.Out), nil,
+		webpipes.OutputPipe,
+	)
+	http.Handle("/webpipe/routed/", webpipes.NetworkHandlerInOut(site.In, output.Out, site, hello, output))
+
 	// CGI Examples
 	pwd, pwderr := os.Getwd()
 	if pwderr != nil {
@@ -95,7 +112,10 @@ func main() {
 	cgiscripts := []string{"echo_post.py", "hello.py", "printenv.py", "test.sh"}
 	for _, script := range cgiscripts {
 		http.Handle(path.Join("/cgi-bin", script), webpipes.Chain(
-			webpipes.CGIServer(path.Join(cgipath, script), "/cgi-bin/"),
+			webpipes.NewCGIServer(path.Join(cgipath, script), "/cgi-bin/", webpipes.CGIOptions{
+				Timeout:       10 * time.Second,
+				MaxConcurrent: 4,
+			}),
 			webpipes.OutputPipe,
 		))
 	}
@@ -111,6 +131,33 @@ func main() {
 		webpipes.OutputPipe,
 	))
 
+	// A single chain that asks for authentication under /private/ and only
+	// compresses text
+	users := map[string]string{"webpipes": "webpipes"}
+	http.Handle("/combined/", webpipes.Chain(
+		webpipes.If(webpipes.PathPrefix("/combined/example/private/"),
+			webpipes.SimpleAuth(users, "webpipes", nil), nil),
+		webpipes.FileServer("../http-data", "/combined/"),
+		webpipes.If(webpipes.ContentType("text/"), webpipes.CompressionPipe, nil),
+		webpipes.OutputPipe,
+	))
+
+	// A cached greeting, with validators derived from the content
+	cache := webpipes.NewCache(16 << 20)
+	cached := webpipes.Chain(
+		cache.Lookup(nil),
+		webpipes.TextStringSource(helloworld),
+		webpipes.Pipe(func(conn *webpipes.Conn, req *http.Request) bool {
+			conn.SetHeader("Cache-Control", "max-age=60, stale-while-revalidate=60")
+			return true
+		}),
+		webpipes.ETagFilter,
+		cache.Store(),
+		webpipes.OutputPipe,
+	)
+	cache.Revalidate = cached
+	http.Handle("/cached/hello", cached)
+
 	//	var second int64 = 1e9
 	server := &http.Server{
 		Addr:    ":12345",
@@ -0,0 +1,571 @@
+package webpipes
+
+import "bufio"
+import "bytes"
+import "context"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "path"
+import "path/filepath"
+import "strings"
+import "sync"
+
+//////////////////////////////////////////////////////////////////////////////
+// FastCGI
+//
+// Rather than starting a process for each request, a FastCGI application
+// server (such as PHP-FPM) keeps its workers running and is sent requests
+// over a socket as a series of records. Each record carries the ID of the
+// request it belongs to, so one connection can carry several requests at
+// once if the server allows it. Connections are kept open between requests
+// and shared out by a pool.
+//
+// Output is handed to each request as it is read from the connection. When
+// requests share a connection, up to fcgiMaxBuffered bytes of the output of
+// each is buffered, so that a client reading slowly doesn't hold up the
+// others until it falls that far behind, at which point reading from the
+// connection waits for it. Otherwise a record at a time is passed on, and
+// the application waits for the client.
+// FastCGI has no way to send a body of unknown length, so a chunked request
+// body is read in full first to find its length, up to MaxSpooledBody.
+
+const (
+	fcgiVersion = 1
+
+	fcgiBeginRequest = 1
+	fcgiAbortRequest = 2
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiMaxContent = 65535
+
+	// The most requests a connection can carry at once, since each needs
+	// an ID other than zero
+	fcgiMaxRequests = 65535
+
+	// How much of the output of a request is buffered when it shares its
+	// connection
+	fcgiMaxBuffered = 256 << 10
+)
+
+// The reasons a FastCGI server gives for refusing a request
+var fcgiProtocolStatus = map[byte]string{
+	1: "cannot multiplex connections",
+	2: "overloaded",
+	3: "unknown role",
+}
+
+// Returned when a FastCGI connection fails while requests are using it
+var ErrGatewayClosed = errors.New("webpipes: connection to application server closed")
+
+// Returned when a connection has no request IDs left
+var errFCGIRequestIDs = errors.New("webpipes: no FastCGI request IDs left on connection")
+
+// Pass requests to the FastCGI application server at 'addr' on 'network'
+// ("tcp" or "unix"). 'prefix' is stripped from the URL being requested to
+// find the script to run below 'root', the document root of the server.
+func FastCGIServer(network, addr, root, prefix string) Source {
+	return NewFastCGIServer(network, addr, root, prefix, GatewayOptions{})
+}
+
+// As FastCGIServer, configured with 'opts'
+func NewFastCGIServer(network, addr, root, prefix string, opts GatewayOptions) Source {
+	opts.defaults()
+	pool := &fcgiPool{network: network, addr: addr, opts: opts, changed: make(chan struct{})}
+
+	return func(conn *Conn, req *http.Request, writer io.WriteCloser) bool {
+		if err := spoolRequest(conn, req, opts.MaxSpooledBody); err != nil {
+			writer.Close()
+			log.Printf("webpipes: cannot read request body for %s: %s", req.URL, err)
+			conn.HTTPStatusResponse(errorStatus(err))
+			return true
+		}
+
+		script := path.Clean("/" + strings.TrimPrefix(req.URL.Path, prefix))
+		env := newCGIEnv(conn, req, path.Join(prefix, script), "", filepath.Join(root, filepath.FromSlash(script)))
+		env.set("DOCUMENT_ROOT", root)
+		env.setAll(opts.Env)
+
+		resp, err := gatewayHeader(conn, opts.Timeout, func(ctx context.Context) (*gatewayResponse, error) {
+			fc, err := pool.acquire(ctx)
+			if err != nil {
+				return nil, err
+			}
+			freq, err := fc.begin(env)
+			if err != nil {
+				return nil, err
+			}
+			conn.Go(func() {
+				freq.sendStdin(req.Body)
+			})
+			return &gatewayResponse{bufio.NewReader(freq.stdout), freq.abort}, nil
+		})
+		if err != nil {
+			writer.Close()
+			proxyError(conn, req, err)
+			return true
+		}
+		gatewayBody(conn, resp, writer)
+		return true
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// FastCGI connections
+
+// A pool of connections to a FastCGI server
+type fcgiPool struct {
+	network, addr string
+	opts          GatewayOptions
+
+	mu      sync.Mutex
+	conns   []*fcgiConn
+	dialing int
+
+	// Closed and replaced whenever a connection is released
+	changed chan struct{}
+}
+
+// A connection to a FastCGI server
+type fcgiConn struct {
+	pool *fcgiPool
+	nc   net.Conn
+
+	// Held while writing a record
+	wmu sync.Mutex
+
+	// The number of requests using the connection, protected by the mutex
+	// of the pool
+	active int
+
+	mu       sync.Mutex
+	requests map[uint16]*fcgiRequest
+	nextID   uint16
+	broken   bool
+}
+
+// A request in progress on a connection
+type fcgiRequest struct {
+	id     uint16
+	fc     *fcgiConn
+	stdout *fcgiOutput
+}
+
+// The output of a request, which the read loop adds to until it holds
+// 'limit' bytes, and then waits for it to be read
+type fcgiOutput struct {
+	mu    sync.Mutex
+	cond  sync.Cond
+	buf   bytes.Buffer
+	limit int
+
+	// Returned once the buffer is empty, set when the output ends
+	err error
+
+	// Set once nobody is reading the output
+	discarded bool
+}
+
+// Return a connection with room for another request, opening one if
+// necessary and waiting if the pool is full
+func (p *fcgiPool) acquire(ctx context.Context) (*fcgiConn, error) {
+	for {
+		p.mu.Lock()
+		var best *fcgiConn
+		for _, fc := range p.conns {
+			if fc.isBroken() || (!p.opts.Multiplex && fc.active > 0) || fc.active >= fcgiMaxRequests {
+				continue
+			}
+			if best == nil || fc.active < best.active {
+				best = fc
+			}
+		}
+		if best != nil {
+			best.active++
+			p.mu.Unlock()
+			return best, nil
+		}
+
+		// Requests that can share a connection wait for one being opened
+		if !p.full() && !(p.opts.Multiplex && p.dialing > 0) {
+			p.dialing++
+			p.mu.Unlock()
+			fc, err := p.dial(ctx)
+			p.mu.Lock()
+			p.dialing--
+			if err == nil {
+				fc.active = 1
+				p.conns = append(p.conns, fc)
+			}
+			p.signal()
+			p.mu.Unlock()
+			return fc, err
+		}
+
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// Report whether no more connections may be opened. The mutex must be held.
+func (p *fcgiPool) full() bool {
+	return p.opts.MaxConns > 0 && len(p.conns)+p.dialing >= p.opts.MaxConns
+}
+
+// Wake anything waiting for a connection. The mutex must be held.
+func (p *fcgiPool) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Open a new connection
+func (p *fcgiPool) dial(ctx context.Context) (*fcgiConn, error) {
+	dialer := net.Dialer{Timeout: p.opts.DialTimeout}
+	nc, err := dialer.DialContext(ctx, p.network, p.addr)
+	if err != nil {
+		return nil, err
+	}
+	fc := &fcgiConn{pool: p, nc: nc, requests: make(map[uint16]*fcgiRequest)}
+	go fc.readLoop()
+	return fc, nil
+}
+
+// Give back a connection once a request has finished with it, closing it if
+// it has failed or too many connections are idle
+func (p *fcgiPool) release(fc *fcgiConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fc.active--
+	idle := 0
+	for _, other := range p.conns {
+		if other.active == 0 {
+			idle++
+		}
+	}
+	if fc.isBroken() || (fc.active == 0 && idle > p.opts.MaxIdle) {
+		p.drop(fc)
+	}
+	p.signal()
+}
+
+// Close a connection and remove it from the pool. The mutex must be held.
+func (p *fcgiPool) drop(fc *fcgiConn) {
+	for i, other := range p.conns {
+		if other == fc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			break
+		}
+	}
+	fc.nc.Close()
+}
+
+func (fc *fcgiConn) isBroken() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.broken
+}
+
+// Start a request, sending the records that begin it and its parameters
+func (fc *fcgiConn) begin(env cgiEnv) (*fcgiRequest, error) {
+	fc.mu.Lock()
+	if fc.broken {
+		fc.mu.Unlock()
+		fc.pool.release(fc)
+		return nil, ErrGatewayClosed
+	}
+	if len(fc.requests) >= fcgiMaxRequests {
+		fc.mu.Unlock()
+		fc.pool.release(fc)
+		return nil, errFCGIRequestIDs
+	}
+	for {
+		fc.nextID++
+		if fc.nextID != 0 && fc.requests[fc.nextID] == nil {
+			break
+		}
+	}
+	limit := 0
+	if fc.pool.opts.Multiplex {
+		limit = fcgiMaxBuffered
+	}
+	freq := &fcgiRequest{id: fc.nextID, fc: fc, stdout: newFCGIOutput(limit)}
+	fc.requests[freq.id] = freq
+	fc.mu.Unlock()
+
+	begin := []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+	err := fc.writeRecord(fcgiBeginRequest, freq.id, begin)
+	if err == nil {
+		err = fc.writeStream(fcgiParams, freq.id, encodeFCGIParams(env))
+	}
+	if err != nil {
+		fc.fail(err)
+		return nil, err
+	}
+	return freq, nil
+}
+
+// Send the body of the request, which the server reads as its standard input
+func (freq *fcgiRequest) sendStdin(body io.ReadCloser) {
+	var err error
+	if body != nil {
+		buf := make([]byte, 32<<10)
+		for err == nil {
+			var n int
+			n, err = body.Read(buf)
+			if n > 0 {
+				if werr := freq.fc.writeRecord(fcgiStdin, freq.id, buf[:n]); werr != nil {
+					return
+				}
+			}
+		}
+		if err != io.EOF {
+			freq.abort()
+			return
+		}
+	}
+	freq.fc.writeRecord(fcgiStdin, freq.id, nil)
+}
+
+// Abandon the request if it has not finished. A connection that only carries
+// this request is simply closed, otherwise the server is asked to stop.
+func (freq *fcgiRequest) abort() {
+	fc := freq.fc
+	fc.mu.Lock()
+	if fc.requests[freq.id] != freq {
+		// Finished, and the connection may already be in use again
+		fc.mu.Unlock()
+		return
+	}
+	fc.mu.Unlock()
+
+	// Discarding the output releases the read loop if it is waiting for
+	// room to add to it
+	freq.stdout.discard(ErrGatewayClosed)
+	if !fc.pool.opts.Multiplex {
+		fc.nc.Close()
+		return
+	}
+	fc.writeRecord(fcgiAbortRequest, freq.id, nil)
+}
+
+// Write a single record
+func (fc *fcgiConn) writeRecord(recType byte, id uint16, content []byte) error {
+	var header [8]byte
+	padding := -len(content) & 7
+	header[0] = fcgiVersion
+	header[1] = recType
+	binary.BigEndian.PutUint16(header[2:], id)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	header[6] = byte(padding)
+
+	fc.wmu.Lock()
+	defer fc.wmu.Unlock()
+	if _, err := fc.nc.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := fc.nc.Write(content); err != nil {
+		return err
+	}
+	_, err := fc.nc.Write(make([]byte, padding))
+	return err
+}
+
+// Write 'data' as a stream of records, ended by an empty one
+func (fc *fcgiConn) writeStream(recType byte, id uint16, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := fc.writeRecord(recType, id, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return fc.writeRecord(recType, id, nil)
+}
+
+// Read records from the server and hand them to the requests they belong to
+func (fc *fcgiConn) readLoop() {
+	br := bufio.NewReader(fc.nc)
+	content := make([]byte, fcgiMaxContent+255)
+	logger := fc.pool.opts.Stderr
+	name := "fastcgi " + fc.pool.addr
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			fc.fail(err)
+			return
+		}
+		recType := header[1]
+		id := binary.BigEndian.Uint16(header[2:])
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		padding := int(header[6])
+		if header[0] != fcgiVersion {
+			fc.fail(fmt.Errorf("%w: unsupported FastCGI version %d", ErrBadCGIResponse, header[0]))
+			return
+		}
+		if _, err := io.ReadFull(br, content[:length+padding]); err != nil {
+			fc.fail(err)
+			return
+		}
+		data := content[:length]
+
+		fc.mu.Lock()
+		freq := fc.requests[id]
+		fc.mu.Unlock()
+		if freq == nil {
+			continue
+		}
+
+		switch recType {
+		case fcgiStdout:
+			if len(data) > 0 {
+				freq.stdout.write(data)
+			}
+		case fcgiStderr:
+			if len(data) > 0 {
+				logStderr(logger, name, data)
+			}
+		case fcgiEndRequest:
+			var err error
+			if len(data) >= 5 && data[4] != 0 {
+				err = fmt.Errorf("webpipes: FastCGI request refused: %s", fcgiProtocolStatus[data[4]])
+			}
+			fc.finish(freq, err)
+		}
+	}
+}
+
+// Finish a request, ending its output with 'err' or EOF if nil
+func (fc *fcgiConn) finish(freq *fcgiRequest, err error) {
+	fc.mu.Lock()
+	if fc.requests[freq.id] != freq {
+		fc.mu.Unlock()
+		return
+	}
+	delete(fc.requests, freq.id)
+	fc.mu.Unlock()
+
+	freq.stdout.end(err)
+	fc.pool.release(fc)
+}
+
+// Mark the connection as broken, failing every request using it
+func (fc *fcgiConn) fail(err error) {
+	fc.mu.Lock()
+	fc.broken = true
+	var requests []*fcgiRequest
+	for _, freq := range fc.requests {
+		requests = append(requests, freq)
+	}
+	fc.mu.Unlock()
+
+	pool := fc.pool
+	pool.mu.Lock()
+	pool.drop(fc)
+	pool.signal()
+	pool.mu.Unlock()
+
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		err = ErrGatewayClosed
+	}
+	for _, freq := range requests {
+		fc.finish(freq, err)
+	}
+}
+
+func newFCGIOutput(limit int) *fcgiOutput {
+	out := &fcgiOutput{limit: limit}
+	out.cond.L = &out.mu
+	return out
+}
+
+// Add 'data' to the output, unless nobody is reading it, first waiting for
+// there to be room for it. Something can always be added once the buffer
+// is empty, however small the limit.
+func (out *fcgiOutput) write(data []byte) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	for out.buf.Len() > 0 && out.buf.Len()+len(data) > out.limit && !out.discarded && out.err == nil {
+		out.cond.Wait()
+	}
+	if !out.discarded && out.err == nil {
+		out.buf.Write(data)
+		out.cond.Broadcast()
+	}
+}
+
+// End the output with 'err', or EOF if nil, once what is buffered is read
+func (out *fcgiOutput) end(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.err == nil {
+		out.err = err
+	}
+	out.cond.Broadcast()
+}
+
+// Throw away the output, so that reads return 'err' straight away
+func (out *fcgiOutput) discard(err error) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.discarded = true
+	out.err = err
+	out.buf.Reset()
+	out.cond.Broadcast()
+}
+
+func (out *fcgiOutput) Read(p []byte) (int, error) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	for out.buf.Len() == 0 && out.err == nil {
+		out.cond.Wait()
+	}
+	if out.buf.Len() > 0 {
+		// There is now room for the read loop to add more
+		out.cond.Broadcast()
+		return out.buf.Read(p)
+	}
+	return 0, out.err
+}
+
+// Encode the parameters of a request as FastCGI name-value pairs
+func encodeFCGIParams(env cgiEnv) []byte {
+	var buf []byte
+	for _, v := range env {
+		buf = appendFCGILength(buf, len(v.name))
+		buf = appendFCGILength(buf, len(v.value))
+		buf = append(buf, v.name...)
+		buf = append(buf, v.value...)
+	}
+	return buf
+}
+
+func appendFCGILength(buf []byte, n int) []byte {
+	if n < 128 {
+		return append(buf, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(buf, uint32(n)|1<<31)
+}
@@ -0,0 +1,163 @@
+package webpipes
+
+import "bufio"
+import "context"
+import "fmt"
+import "io"
+import "net"
+import "net/http"
+import "net/http/fcgi"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+// Start a FastCGI server running 'handler', returning its address
+func testFastCGI(t *testing.T, handler http.Handler) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go fcgi.Serve(ln, handler)
+	return ln.Addr().String()
+}
+
+func TestFastCGIStalledClient(t *testing.T) {
+	// Less than is buffered for each request, which is all a client can
+	// fall behind by before it holds up the others
+	large := strings.Repeat("x", fcgiMaxBuffered/2)
+	addr := testFastCGI(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/large" {
+			io.WriteString(w, large)
+			return
+		}
+		io.WriteString(w, "small")
+	}))
+
+	// Both requests share a single connection to the application server
+	opts := GatewayOptions{MaxConns: 1, Multiplex: true}
+	srv := httptest.NewServer(Chain(NewFastCGIServer("tcp", addr, "/", "", opts), OutputPipe))
+	defer srv.Close()
+
+	// Ask for the large response without reading it
+	nc, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	fmt.Fprintf(nc, "GET /large HTTP/1.1\r\nHost: test\r\n\r\n")
+	if _, err := http.ReadResponse(bufio.NewReader(nc), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL + "/small")
+	if err != nil {
+		t.Fatalf("request held up by a stalled client: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "small" {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestFastCGIChunkedBody(t *testing.T) {
+	addr := testFastCGI(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "length=%d\n%s", req.ContentLength, body)
+	}))
+	chain := Chain(FastCGIServer("tcp", addr, "/", ""), OutputPipe)
+
+	req := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body")))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if want := "length=12\nchunked body"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("status %d, body %q, want %q", rec.Code, rec.Body, want)
+	}
+}
+
+// Report whether 'fn' finishes within a short while
+func finishes(fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func TestFCGIOutputLimit(t *testing.T) {
+	for _, limit := range []int{0, 10} {
+		out := newFCGIOutput(limit)
+		if !finishes(func() { out.write([]byte("12345678")) }) {
+			t.Fatalf("limit %d: first write blocked", limit)
+		}
+
+		// The second write has to wait for the first to be read
+		done := make(chan struct{})
+		go func() {
+			out.write([]byte("abcdefgh"))
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Errorf("limit %d: write went past the limit", limit)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		buf := make([]byte, 8)
+		if n, err := io.ReadFull(out, buf); n != 8 || err != nil || string(buf) != "12345678" {
+			t.Errorf("limit %d: read %q, %v", limit, buf[:n], err)
+		}
+		<-done
+		out.end(nil)
+		if rest, err := io.ReadAll(out); string(rest) != "abcdefgh" || err != nil {
+			t.Errorf("limit %d: read %q, %v", limit, rest, err)
+		}
+	}
+
+	// Nothing waits once the output has been discarded
+	out := newFCGIOutput(0)
+	out.write([]byte("12345678"))
+	go out.discard(ErrGatewayClosed)
+	if !finishes(func() { out.write([]byte("abcdefgh")) }) {
+		t.Errorf("write blocked after discard")
+	}
+	if _, err := out.Read(make([]byte, 8)); err != ErrGatewayClosed {
+		t.Errorf("read after discard: %v", err)
+	}
+}
+
+func TestFastCGIRequestIDs(t *testing.T) {
+	pool := &fcgiPool{changed: make(chan struct{}), opts: GatewayOptions{MaxIdle: 2}}
+	fc := &fcgiConn{pool: pool, requests: make(map[uint16]*fcgiRequest), active: 2}
+	pool.conns = []*fcgiConn{fc}
+	for id := 1; id <= fcgiMaxRequests; id++ {
+		fc.requests[uint16(id)] = &fcgiRequest{}
+	}
+	if !finishes(func() {
+		if _, err := fc.begin(nil); err != errFCGIRequestIDs {
+			t.Errorf("begin: %v", err)
+		}
+	}) {
+		t.Fatalf("begin did not return with every ID in use")
+	}
+
+	// The pool looks elsewhere for a full connection
+	fc.active = fcgiMaxRequests
+	pool.opts.Multiplex = true
+	pool.opts.MaxConns = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.acquire(ctx); err == nil {
+		t.Errorf("full connection acquired")
+	}
+}
@@ -0,0 +1,227 @@
+package webpipes
+
+import "compress/gzip"
+import "fmt"
+import "io"
+import "log"
+import "mime"
+import "net/http"
+import "os"
+import "path"
+import "path/filepath"
+import "strings"
+import "time"
+
+import "github.com/jnwhiteh/webpipes/negotiate"
+
+//////////////////////////////////////////////////////////////////////////////
+// Precompressed static files
+//
+// Compressing static files with CompressionPipe means compressing them again
+// on every request. Instead, the file server looks for a sibling of the
+// requested file with the extension of a content coding (such as style.css.gz
+// next to style.css) and, if the client accepts that coding, serves it as it
+// is with the appropriate Content-Encoding. Since the encoded response is
+// served by http.ServeContent, range and conditional requests work as they do
+// for any other file, with an ETag that is specific to the encoding.
+//
+// If a cache directory is given, gzip versions of files that have no sibling
+// are built there on the first request for them, and rebuilt whenever the
+// original file changes. Files such as images, which are compressed already,
+// are left alone.
+
+// Options for a file server
+type FileServerOptions struct {
+	// The content codings to look for, in order of preference, mapped to the
+	// file extension used for each. DefaultPrecompressed if nil.
+	Precompressed []PrecompressedEncoding
+
+	// If not empty, build gzip versions of files in this directory
+	CacheDir string
+
+	// Files with one of these media types, which are already compressed,
+	// are not compressed into CacheDir. A type ending in "/*" matches every
+	// subtype. DefaultCompressionOptions.DenyTypes if nil.
+	DenyTypes []string
+}
+
+// A content coding and the extension of files encoded with it
+type PrecompressedEncoding struct {
+	Encoding  string
+	Extension string
+}
+
+// The precompressed files looked for by FileServer
+var DefaultPrecompressed = []PrecompressedEncoding{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// Serve files from 'root', stripping 'prefix' from the URL being requested,
+// configured with 'opts'
+func NewFileServer(root, prefix string, opts FileServerOptions) Component {
+	if opts.Precompressed == nil {
+		opts.Precompressed = DefaultPrecompressed
+	}
+	if opts.DenyTypes == nil {
+		opts.DenyTypes = DefaultCompressionOptions.DenyTypes
+	}
+	fs := &precompressedFileServer{
+		root:     root,
+		opts:     opts,
+		fallback: http.FileServer(http.Dir(root)),
+	}
+	return NewHandlerComponent(http.StripPrefix(prefix, fs))
+}
+
+type precompressedFileServer struct {
+	root     string
+	opts     FileServerOptions
+	fallback http.Handler
+}
+
+// A precompressed version of a file that is available to be served
+type fileVariant struct {
+	encoding string
+	path     string
+	info     os.FileInfo
+}
+
+func (fs *precompressedFileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := path.Clean("/" + req.URL.Path)
+	if (req.Method != "GET" && req.Method != "HEAD") || strings.HasSuffix(req.URL.Path, "/") {
+		fs.fallback.ServeHTTP(w, req)
+		return
+	}
+
+	original := filepath.Join(fs.root, filepath.FromSlash(name))
+	info, err := os.Stat(original)
+	if err != nil || info.IsDir() {
+		fs.fallback.ServeHTTP(w, req)
+		return
+	}
+
+	variants := fs.variants(name, original, info)
+	if len(variants) == 0 {
+		fs.fallback.ServeHTTP(w, req)
+		return
+	}
+
+	// Whether or not an encoded file is served, the response depends on
+	// the encodings the client accepts
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	offers := make([]string, 0, len(variants)+1)
+	for _, variant := range variants {
+		offers = append(offers, variant.encoding)
+	}
+	choice := negotiate.Encoding(req.Header, append(offers, "identity")...)
+
+	for _, variant := range variants {
+		if variant.encoding == choice {
+			fs.serveVariant(w, req, name, variant)
+			return
+		}
+	}
+	fs.fallback.ServeHTTP(w, req)
+}
+
+// Find the encoded versions of 'original' that are at least as new as it is
+func (fs *precompressedFileServer) variants(name, original string, info os.FileInfo) []fileVariant {
+	var variants []fileVariant
+	haveGzip := false
+
+	for _, pc := range fs.opts.Precompressed {
+		vinfo, err := os.Stat(original + pc.Extension)
+		if err != nil || vinfo.IsDir() || vinfo.ModTime().Before(info.ModTime()) {
+			continue
+		}
+		variants = append(variants, fileVariant{pc.Encoding, original + pc.Extension, vinfo})
+		haveGzip = haveGzip || pc.Encoding == "gzip"
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+	if fs.opts.CacheDir != "" && !haveGzip && !matchMediaType(mediaType, fs.opts.DenyTypes) {
+		cached := filepath.Join(fs.opts.CacheDir, filepath.FromSlash(name)+".gz")
+		vinfo, err := os.Stat(cached)
+		if err != nil || !sameModTime(vinfo.ModTime(), info.ModTime()) {
+			vinfo, err = buildGzip(original, cached, info.ModTime())
+		}
+		if err == nil {
+			variants = append(variants, fileVariant{"gzip", cached, vinfo})
+		} else {
+			log.Printf("webpipes: could not build %s: %s", cached, err)
+		}
+	}
+	return variants
+}
+
+func (fs *precompressedFileServer) serveVariant(w http.ResponseWriter, req *http.Request, name string, variant fileVariant) {
+	file, err := os.Open(variant.path)
+	if err != nil {
+		fs.fallback.ServeHTTP(w, req)
+		return
+	}
+	defer file.Close()
+
+	// The content type is that of the original file, which http.ServeContent
+	// would otherwise guess from the encoded content
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Encoding", variant.encoding)
+	header.Set("ETag", fmt.Sprintf(`"%x-%x-%s"`, variant.info.ModTime().UnixNano(), variant.info.Size(), variant.encoding))
+	http.ServeContent(w, req, name, variant.info.ModTime(), file)
+}
+
+// Compress 'original' into 'cached', giving it the modification time of the
+// original so that it can be recognised as up to date. The file is written
+// under a temporary name and renamed into place, so that concurrent requests
+// never see it half written.
+func buildGzip(original, cached string, modTime time.Time) (os.FileInfo, error) {
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return nil, err
+	}
+
+	src, err := os.Open(original)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(cached), ".webpipes-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	zipw, _ := gzip.NewWriterLevel(tmp, gzip.BestCompression)
+	_, err = io.Copy(zipw, src)
+	if err == nil {
+		err = zipw.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cached)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(cached)
+}
+
+// Compare modification times to the second, since not every file system
+// stores them any more precisely
+func sameModTime(a, b time.Time) bool {
+	return a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+}
@@ -0,0 +1,57 @@
+package webpipes
+
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestFileServerPrecompressed(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("plain text"), 0644)
+	os.WriteFile(filepath.Join(root, "a.txt.br"), []byte("brotli bytes"), 0644)
+	chain := Chain(FileServer(root, "/"), OutputPipe)
+
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"", "", "plain text"},
+		{"br", "br", "brotli bytes"},
+		{"gzip", "", "plain text"},
+		{"br;q=0, identity", "", "plain text"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/a.txt", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		chain.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Encoding"); got != test.encoding {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, want %q", test.acceptEncoding, got, test.encoding)
+		}
+		if got := rec.Body.String(); got != test.body {
+			t.Errorf("Accept-Encoding %q: body %q, want %q", test.acceptEncoding, got, test.body)
+		}
+	}
+}
+
+func TestFileServerCacheDeniedTypes(t *testing.T) {
+	cache := t.TempDir()
+	chain := Chain(NewFileServer("http-data", "/", FileServerOptions{CacheDir: cache}), OutputPipe)
+
+	for _, name := range []string{"ipsum.txt", "waterfall.jpg"} {
+		req := httptest.NewRequest("GET", "/"+name, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		chain.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if _, err := os.Stat(filepath.Join(cache, "ipsum.txt.gz")); err != nil {
+		t.Errorf("text file was not compressed: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(cache, "waterfall.jpg.gz")); err == nil {
+		t.Errorf("image was compressed")
+	}
+}
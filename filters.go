@@ -1,13 +1,16 @@
 package webpipes
 
+import "bytes"
 import "compress/gzip"
 import "compress/flate"
 import "io"
+import "mime"
 import "net/http"
-
 import "strconv"
 import "strings"
 
+import "github.com/jnwhiteh/webpipes/negotiate"
+
 func rot13(b byte) byte {
 	if 'a' <= b && b <= 'z' {
 		b = 'a' + ((b-'a')+13)%26
@@ -32,23 +35,24 @@ func (r13 *rot13Reader) Read(b []byte) (ret int, err error) {
 
 // Rot13 any alphabetic content in the output stream
 var Rot13Filter Filter = func(conn *Conn, req *http.Request, reader io.ReadCloser, writer io.WriteCloser) bool {
-	go func() {
+	conn.ChangeRepresentation()
+	conn.Go(func() {
 		rot13 := &rot13Reader{reader}
 		io.Copy(writer, rot13)
 		writer.Close()
 		reader.Close()
-	}()
+	})
 
 	return true
 }
 
 // Perform an identity transformation on the content stream
 var IdentityFilter Filter = func(conn *Conn, req *http.Request, reader io.ReadCloser, writer io.WriteCloser) bool {
-	go func() {
+	conn.Go(func() {
 		io.Copy(writer, reader)
 		writer.Close()
 		reader.Close()
-	}()
+	})
 
 	return true
 }
@@ -56,114 +60,217 @@ var IdentityFilter Filter = func(conn *Conn, req *http.Request, reader io.ReadCl
 //////////////////////////////////////////////////////////////////////////////
 // Compression components
 
-// This component checks the Accept-Encoding header, and the HTTP 1.0
-// equivalents to determine if compression is possible, and utilizes
-// whichever has the highest qval. If compression is not possible, then
-// control is passed to the next pipe in the pipeline
-
-var CompressionPipe Pipe = func(conn *Conn, req *http.Request) bool {
-	// TODO: Support HTTP/1.0
-	if req.ProtoAtLeast(1, 1) {
-		// Process "Accept-Encoding" to see if any compressions are valid 
-		header := req.Header.Get("Accept-Encoding")
-		if header == "" {
-			// No accepted encodings, must use plain text
-			return true
-		}
+// This component checks the Accept-Encoding header to determine if
+// compression is possible, and utilizes whichever acceptable encoding has the
+// highest qval, choosing from the encodings registered in DefaultEncodings.
+// If the client does not accept any of the encodings we can produce,
+// including the unencoded content, the response is replaced with a 406.
+// Otherwise, if compression is not possible, then control is passed to the
+// next pipe in the pipeline.
+//
+// Responses that are already encoded, that are marked no-transform, that are
+// too small to benefit, or whose media type is already compressed (such as
+// JPEG or GIF images) are left alone, as set out in
+// DefaultCompressionOptions. Since the response depends on Accept-Encoding,
+// the Vary header is always set accordingly.
 
-		// Generate a map from encodingType -> qvalue (hardcoded to 1.0)
-		encMap := make(map[string]float64)
-		encValues := strings.Split(header, ",")
-
-		for _, encValue := range encValues {
-			var qVal string
-			// Just shamelessly strip the qvalue, as the spec is confusing atm.
-			if idx := strings.Index(encValue, ";"); idx != -1 {
-				encValue = encValue[0:idx]
-				if qidx := strings.Index(encValue, "q="); idx != -1 {
-					qVal = encValue[qidx:]
-				}
-			}
+var CompressionPipe Pipe = NewCompressionPipe(DefaultCompressionOptions)
 
-			var encType string = strings.ToLower(strings.TrimSpace(encValue))
-			var quality float64
+// Options for a compression pipe
+type CompressionOptions struct {
+	// The encodings to choose from, DefaultEncodings if nil
+	Encodings *EncodingRegistry
 
-			if qnum, err := strconv.ParseFloat(qVal, 64); err != nil && len(qVal) > 0 {
-				quality = qnum
-			} else {
-				// Default to 1.0 quality when not specified
-				quality = 1.0
-			}
+	// If not empty, only responses with one of these media types are
+	// compressed. A type ending in "/*" matches every subtype.
+	Types []string
+
+	// Responses with one of these media types are never compressed. A type
+	// ending in "/*" matches every subtype.
+	DenyTypes []string
+
+	// Responses with fewer bytes than this are not compressed. If the
+	// response has no Content-Length, the content is read ahead to find out.
+	MinSize int
+}
+
+// The options used by CompressionPipe
+var DefaultCompressionOptions = CompressionOptions{
+	DenyTypes: []string{
+		"image/*", "audio/*", "video/*", "font/woff", "font/woff2",
+		"application/zip", "application/gzip", "application/x-gzip",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+		"application/x-rar-compressed", "application/pdf",
+	},
+	MinSize: 256,
+}
 
-			encMap[encType] = quality
+// Create a compression pipe that behaves like CompressionPipe, configured
+// with 'opts'
+func NewCompressionPipe(opts CompressionOptions) Pipe {
+	return func(conn *Conn, req *http.Request) bool {
+		encodings := opts.Encodings
+		if encodings == nil {
+			encodings = DefaultEncodings
 		}
 
-		// Check to see if we can deflate/gzip the output
-		var filter Filter
+		addVary(conn, "Accept-Encoding")
+		if !opts.compressible(conn) {
+			return true
+		}
 
-		gz, gzok := encMap["gzip"]
-		fl, flok := encMap["deflate"]
+		offers := append(encodings.Names(), "identity")
+		name := negotiate.Encoding(req.Header, offers...)
+		if name == "identity" {
+			// No compression wanted, must use plain text
+			return true
+		}
 
-		if gzok && flok {
-			if gz >= fl {
-				filter = GzipFilter
-			} else {
-				filter = FlateFilter
-			}
-		} else if gzok {
-			filter = GzipFilter
-		} else if flok {
-			filter = FlateFilter
+		filter := encodings.Filter(name)
+		if filter == nil {
+			conn.HTTPStatusResponse(http.StatusNotAcceptable)
+			return true
 		}
 
-		if filter != nil {
-			// Grab a content reader and writer for the filter function
-			reader := conn.NewContentReader()
-			writer := conn.NewContentWriter()
+		// Grab a content reader and writer for the filter function
+		reader := conn.NewContentReader()
+		if reader == nil {
+			// There is no content to compress
+			return true
+		}
 
-			if reader == nil || writer == nil {
-				// TODO: Output a message to the error log
-				conn.HTTPStatusResponse(http.StatusInternalServerError)
-				return true
-			}
+		reader, large := opts.peek(conn, reader)
+		writer := conn.NewContentWriter()
+		if !large {
+			// Send the content that we have read unchanged
+			conn.Go(func() {
+				io.Copy(writer, reader)
+				reader.Close()
+				writer.Close()
+			})
+			return true
+		}
+
+		return filter(conn, req, reader, writer)
+	}
+}
 
-			return filter(conn, req, reader, writer)
+// Check whether the headers of the response allow it to be compressed
+func (opts *CompressionOptions) compressible(conn *Conn) bool {
+	if encoding := conn.GetHeader("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	if conn.status == http.StatusPartialContent {
+		// The Content-Range refers to the unencoded bytes
+		return false
+	}
+	for _, directive := range strings.Split(conn.GetHeader("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+			return false
 		}
 	}
-	// Nothing to be done
-	return true
+	if length := conn.GetHeader("Content-Length"); length != "" {
+		if n, err := strconv.Atoi(length); err == nil && n < opts.MinSize {
+			return false
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(conn.GetHeader("Content-Type"))
+	if len(opts.Types) > 0 && !matchMediaType(mediaType, opts.Types) {
+		return false
+	}
+	return !matchMediaType(mediaType, opts.DenyTypes)
 }
 
-// Perform unconditional 'gzip' compression of the content stream
-var GzipFilter Filter = func(conn *Conn, req *http.Request, reader io.ReadCloser, writer io.WriteCloser) bool {
-	zipw := gzip.NewWriter(writer)
+func matchMediaType(mediaType string, types []string) bool {
+	for _, t := range types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
 
-	conn.SetHeader("Content-Encoding", "gzip")
-	go func() {
-		io.Copy(zipw, reader)
-		zipw.Close()
-		reader.Close()
-		writer.Close()
-	}()
+// If the response has no Content-Length, read up to MinSize bytes ahead to
+// see whether it is large enough to compress. Return a reader for the whole
+// of the content, and whether it is large enough.
+func (opts *CompressionOptions) peek(conn *Conn, reader io.ReadCloser) (io.ReadCloser, bool) {
+	if opts.MinSize <= 0 || conn.GetHeader("Content-Length") != "" {
+		return reader, true
+	}
 
-	return true
+	buf := make([]byte, opts.MinSize)
+	n, err := io.ReadFull(reader, buf)
+	rest := &prefixReader{io.MultiReader(bytes.NewReader(buf[:n]), reader), reader}
+	return rest, err == nil
 }
 
-// Perform unconditional 'flate' compression of the content stream
-var FlateFilter Filter = func(conn *Conn, req *http.Request, reader io.ReadCloser, writer io.WriteCloser) bool {
-	zipw, err := flate.NewWriter(writer, flate.DefaultCompression)
-	if err != nil {
-		conn.HTTPStatusResponse(http.StatusInternalServerError)
+// A reader that reads content that has been read ahead before carrying on
+// with the rest of the stream
+type prefixReader struct {
+	io.Reader
+	source io.Closer
+}
+
+func (pr *prefixReader) Close() error {
+	return pr.source.Close()
+}
+
+// Add 'field' to the Vary header of the response, unless it is already there
+func addVary(conn *Conn, field string) {
+	header := conn.rwriter.Header()
+	for _, value := range header.Values("Vary") {
+		for _, existing := range strings.Split(value, ",") {
+			existing = strings.TrimSpace(existing)
+			if existing == "*" || strings.EqualFold(existing, field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
+
+// Return a filter that encodes the content stream using the writer returned
+// by 'newWriter', labelling the response with the content coding 'name'.
+func EncoderFilter(name string, newWriter func(io.Writer) (io.WriteCloser, error)) Filter {
+	return func(conn *Conn, req *http.Request, reader io.ReadCloser, writer io.WriteCloser) bool {
+		zipw, err := newWriter(writer)
+		if err != nil {
+			conn.HTTPStatusResponse(http.StatusInternalServerError)
+			return true
+		}
+
+		// The length of the encoded content is not known in advance
+		conn.DelHeader("Content-Length")
+		conn.SetHeader("Content-Encoding", name)
+		conn.ChangeRepresentation()
+		conn.Go(func() {
+			io.Copy(zipw, reader)
+			zipw.Close()
+			reader.Close()
+			writer.Close()
+		})
+
 		return true
 	}
+}
 
-	conn.SetHeader("Content-Encoding", "deflate")
-	go func() {
-		io.Copy(zipw, reader)
-		zipw.Close()
-		reader.Close()
-		writer.Close()
-	}()
+// Return a filter that performs 'gzip' compression at the given level
+func GzipEncoder(level int) Filter {
+	return EncoderFilter("gzip", func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	})
+}
 
-	return true
+// Return a filter that performs 'deflate' compression at the given level
+func FlateEncoder(level int) Filter {
+	return EncoderFilter("deflate", func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
 }
+
+// Perform unconditional 'gzip' compression of the content stream
+var GzipFilter Filter = GzipEncoder(gzip.DefaultCompression)
+
+// Perform unconditional 'flate' compression of the content stream
+var FlateFilter Filter = FlateEncoder(flate.DefaultCompression)
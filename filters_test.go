@@ -0,0 +1,46 @@
+package webpipes
+
+import "compress/gzip"
+import "io"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+func TestCompressionPipeNegotiation(t *testing.T) {
+	text := strings.Repeat("All work and no play makes Jack a dull boy. ", 100)
+	chain := Chain(TextStringSource(text), CompressionPipe, OutputPipe)
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip;q=0", ""},
+		{"identity", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		chain.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Encoding"); got != test.want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, want %q", test.acceptEncoding, got, test.want)
+			continue
+		}
+		var body io.Reader = rec.Body
+		if test.want == "gzip" {
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		if got, _ := io.ReadAll(body); string(got) != text {
+			t.Errorf("Accept-Encoding %q: body differs", test.acceptEncoding)
+		}
+	}
+}
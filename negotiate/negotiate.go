@@ -0,0 +1,268 @@
+// Package negotiate implements proactive content negotiation, as described
+// in section 12 of RFC 9110, for the Accept, Accept-Encoding,
+// Accept-Language and Accept-Charset request headers.
+//
+// Each of the selection functions takes the request headers and the values
+// that the server is able to offer, in order of preference, and returns the
+// offer that the client finds most acceptable. Ties in quality are broken by
+// the order of the offers. An empty string is returned if the client finds
+// none of the offers acceptable.
+package negotiate
+
+import "mime"
+import "net/http"
+import "strconv"
+import "strings"
+
+// A single element of an Accept-style header
+type Preference struct {
+	Value  string            // The value or range, in lower case
+	Q      float64           // The quality value, defaulting to 1
+	Params map[string]string // Any parameters other than the quality value
+}
+
+// Parse the comma-separated elements of the given header field values.
+// Elements with an invalid quality value are ignored.
+func Parse(values []string) []Preference {
+	var prefs []Preference
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			fields := strings.Split(element, ";")
+			pref := Preference{Value: strings.ToLower(strings.TrimSpace(fields[0])), Q: 1}
+			if pref.Value == "" {
+				continue
+			}
+
+			valid := true
+			for _, param := range fields[1:] {
+				key, val, _ := strings.Cut(param, "=")
+				key = strings.ToLower(strings.TrimSpace(key))
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+				if key == "q" {
+					q, ok := parseQuality(val)
+					if !ok {
+						valid = false
+						break
+					}
+					pref.Q = q
+					// Anything after the weight is an extension, not a
+					// parameter of the value
+					break
+				}
+				if key != "" {
+					if pref.Params == nil {
+						pref.Params = make(map[string]string)
+					}
+					pref.Params[key] = strings.ToLower(val)
+				}
+			}
+
+			if valid {
+				prefs = append(prefs, pref)
+			}
+		}
+	}
+	return prefs
+}
+
+// Parse a qvalue, which is a number between 0 and 1 with no more than three
+// digits after the decimal point.
+func parseQuality(s string) (float64, bool) {
+	if s == "" || len(s) > 5 || (s[0] != '0' && s[0] != '1') {
+		return 0, false
+	}
+	if len(s) > 1 && s[1] != '.' {
+		return 0, false
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// Pick the best offer given a function that returns the quality the client
+// assigns to each one.
+func best(offers []string, quality func(offer string) float64) string {
+	choice, bestq := "", 0.0
+	for _, offer := range offers {
+		if q := quality(offer); q > bestq {
+			choice, bestq = offer, q
+		}
+	}
+	return choice
+}
+
+// Select a media type for the response using the Accept header. Offers may
+// include parameters, which must match any parameters given in the
+// client's media range.
+func MediaType(h http.Header, offers ...string) string {
+	values := h.Values("Accept")
+	if len(values) == 0 {
+		return first(offers)
+	}
+	prefs := Parse(values)
+
+	return best(offers, func(offer string) float64 {
+		mediaType, params, err := mime.ParseMediaType(offer)
+		if err != nil {
+			return 0
+		}
+		mainType, _, _ := strings.Cut(mediaType, "/")
+
+		q, specificity := 0.0, -1
+		for _, pref := range prefs {
+			var spec int
+			switch {
+			case pref.Value == mediaType:
+				spec = 2
+			case pref.Value == mainType+"/*":
+				spec = 1
+			case pref.Value == "*/*":
+				spec = 0
+			default:
+				continue
+			}
+			if !paramsMatch(pref.Params, params) {
+				continue
+			}
+			// More specific ranges, and ranges with more parameters,
+			// override less specific ones
+			spec = spec*100 + len(pref.Params)
+			if spec > specificity {
+				q, specificity = pref.Q, spec
+			}
+		}
+		return q
+	})
+}
+
+func paramsMatch(want, have map[string]string) bool {
+	for key, val := range want {
+		if strings.ToLower(have[key]) != val {
+			return false
+		}
+	}
+	return true
+}
+
+// Aliases for content codings that must be treated as equivalent
+var encodingAliases = map[string]string{
+	"x-gzip":     "gzip",
+	"x-compress": "compress",
+}
+
+func canonicalEncoding(coding string) string {
+	coding = strings.ToLower(coding)
+	if alias, ok := encodingAliases[coding]; ok {
+		return alias
+	}
+	return coding
+}
+
+// Select a content coding for the response using the Accept-Encoding header.
+// The "identity" coding should be offered if an unencoded response is
+// possible. It is acceptable unless the client explicitly excludes it, either
+// by name or with "*;q=0", and is chosen whenever it is offered to a client
+// that sends no Accept-Encoding header, since such a client may not be able
+// to decode anything else.
+func Encoding(h http.Header, offers ...string) string {
+	values := h.Values("Accept-Encoding")
+	if len(values) == 0 {
+		for _, offer := range offers {
+			if strings.EqualFold(offer, "identity") {
+				return offer
+			}
+		}
+		return first(offers)
+	}
+	prefs := Parse(values)
+
+	return best(offers, func(offer string) float64 {
+		coding := canonicalEncoding(offer)
+		wildcard := -1.0
+		for _, pref := range prefs {
+			if canonicalEncoding(pref.Value) == coding {
+				return pref.Q
+			}
+			if pref.Value == "*" {
+				wildcard = pref.Q
+			}
+		}
+		if wildcard >= 0 {
+			return wildcard
+		}
+		if coding == "identity" {
+			// Not mentioned at all, so still acceptable, but anything the
+			// client asked for by name is preferred.
+			return 0.001
+		}
+		return 0
+	})
+}
+
+// Select a language for the response using the Accept-Language header. Each
+// language range matches tags that are equal to it or that begin with it
+// followed by a "-", and the longest matching range decides the quality.
+func Language(h http.Header, offers ...string) string {
+	values := h.Values("Accept-Language")
+	if len(values) == 0 {
+		return first(offers)
+	}
+	prefs := Parse(values)
+
+	return best(offers, func(offer string) float64 {
+		tag := strings.ToLower(offer)
+		q, length := 0.0, -1
+		for _, pref := range prefs {
+			matched := pref.Value == "*" || pref.Value == tag ||
+				strings.HasPrefix(tag, pref.Value+"-")
+			if !matched {
+				continue
+			}
+			l := len(pref.Value)
+			if pref.Value == "*" {
+				l = 0
+			}
+			if l > length {
+				q, length = pref.Q, l
+			}
+		}
+		return q
+	})
+}
+
+// Select a charset for the response using the Accept-Charset header
+func Charset(h http.Header, offers ...string) string {
+	values := h.Values("Accept-Charset")
+	if len(values) == 0 {
+		return first(offers)
+	}
+	prefs := Parse(values)
+
+	return best(offers, func(offer string) float64 {
+		charset := strings.ToLower(offer)
+		wildcard := 0.0
+		for _, pref := range prefs {
+			if pref.Value == charset {
+				return pref.Q
+			}
+			if pref.Value == "*" {
+				wildcard = pref.Q
+			}
+		}
+		return wildcard
+	})
+}
+
+func first(offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	return offers[0]
+}
@@ -0,0 +1,135 @@
+package negotiate
+
+import "net/http"
+import "reflect"
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []Preference
+	}{
+		{"gzip", []Preference{{Value: "gzip", Q: 1}}},
+		{"GZIP;Q=0.5, br", []Preference{{Value: "gzip", Q: 0.5}, {Value: "br", Q: 1}}},
+		{"text/html;level=1;q=0.7;ext=x", []Preference{{Value: "text/html", Q: 0.7, Params: map[string]string{"level": "1"}}}},
+		{"a;q=\"0.3\"", []Preference{{Value: "a", Q: 0.3}}},
+		{" , a ,, ", []Preference{{Value: "a", Q: 1}}},
+		{"a;q=0", []Preference{{Value: "a", Q: 0}}},
+		{"a;q=0., b;q=1.000", []Preference{{Value: "a", Q: 0}, {Value: "b", Q: 1}}},
+
+		// Invalid quality values drop the element
+		{"a;q=1.5, b", []Preference{{Value: "b", Q: 1}}},
+		{"a;q=0.1234, b", []Preference{{Value: "b", Q: 1}}},
+		{"a;q=.5, b", []Preference{{Value: "b", Q: 1}}},
+		{"a;q=2, b", []Preference{{Value: "b", Q: 1}}},
+		{"a;q=0.1e1, b", []Preference{{Value: "b", Q: 1}}},
+		{"a;q=-0, b", []Preference{{Value: "b", Q: 1}}},
+		{"a;q=, b", []Preference{{Value: "b", Q: 1}}},
+	}
+	for _, test := range tests {
+		if got := Parse([]string{test.header}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.header, got, test.want)
+		}
+	}
+}
+
+// Run a table of negotiations for the header 'name' through 'choose'
+func checkNegotiation(t *testing.T, name string, choose func(http.Header, ...string) string, tests []negotiation) {
+	t.Helper()
+	for _, test := range tests {
+		h := make(http.Header)
+		if test.header != "-" {
+			h.Set(name, test.header)
+		}
+		if got := choose(h, test.offers...); got != test.want {
+			t.Errorf("%s: %q with offers %q chose %q, want %q", name, test.header, test.offers, got, test.want)
+		}
+	}
+}
+
+// A header value, or "-" for none, and the offer it should choose
+type negotiation struct {
+	header string
+	offers []string
+	want   string
+}
+
+func TestMediaType(t *testing.T) {
+	checkNegotiation(t, "Accept", MediaType, []negotiation{
+		{"-", []string{"text/html", "text/plain"}, "text/html"},
+		{"text/plain", []string{"text/html", "text/plain"}, "text/plain"},
+		{"text/*;q=0.5, text/html", []string{"text/plain", "text/html"}, "text/html"},
+		{"*/*;q=0.1, text/*;q=0.5", []string{"image/png", "text/plain"}, "text/plain"},
+		{"*/*", []string{"image/png", "text/plain"}, "image/png"},
+
+		// More specific ranges override wildcards, even with a lower q
+		{"text/*, text/html;q=0", []string{"text/html", "text/plain"}, "text/plain"},
+		{"*/*, image/*;q=0", []string{"image/png"}, ""},
+
+		// Parameters must match
+		{"text/html;level=1", []string{"text/html;level=2", "text/html;level=1"}, "text/html;level=1"},
+		{"text/html;level=1;q=0.2, text/html", []string{"text/html;level=1", "text/html"}, "text/html"},
+		{"text/html;level=1", []string{"text/html"}, ""},
+
+		// Ties go to the first offer
+		{"text/html, text/plain", []string{"text/plain", "text/html"}, "text/plain"},
+		{"application/json", []string{"text/html"}, ""},
+		{"text/html", nil, ""},
+	})
+}
+
+func TestEncoding(t *testing.T) {
+	checkNegotiation(t, "Accept-Encoding", Encoding, []negotiation{
+		// No header means identity, if it is offered
+		{"-", []string{"gzip", "identity"}, "identity"},
+		{"-", []string{"gzip", "IDENTITY"}, "IDENTITY"},
+		{"-", []string{"gzip", "br"}, "gzip"},
+
+		{"gzip", []string{"br", "gzip", "identity"}, "gzip"},
+		{"gzip;q=0.5, br", []string{"gzip", "br"}, "br"},
+		{"", []string{"gzip", "identity"}, "identity"},
+
+		// Identity is acceptable unless excluded
+		{"br", []string{"gzip", "identity"}, "identity"},
+		{"gzip, identity;q=0", []string{"identity"}, ""},
+		{"*;q=0", []string{"identity", "gzip"}, ""},
+		{"gzip, *;q=0", []string{"identity", "gzip"}, "gzip"},
+		{"*", []string{"br", "identity"}, "br"},
+		{"*;q=0.5, identity", []string{"br", "identity"}, "identity"},
+
+		// x-gzip is gzip, whichever side uses it
+		{"x-gzip", []string{"gzip"}, "gzip"},
+		{"gzip", []string{"x-gzip"}, "x-gzip"},
+		{"x-gzip;q=0, br", []string{"gzip", "br"}, "br"},
+		{"x-compress", []string{"compress"}, "compress"},
+	})
+}
+
+func TestLanguage(t *testing.T) {
+	checkNegotiation(t, "Accept-Language", Language, []negotiation{
+		{"-", []string{"en", "fr"}, "en"},
+		{"fr", []string{"en", "fr"}, "fr"},
+		{"fr", []string{"en", "fr-CA"}, "fr-CA"},
+		{"fr-ca", []string{"fr", "fr-CA"}, "fr-CA"},
+		{"fr-CA", []string{"fr"}, ""},
+		{"en;q=0.5, fr", []string{"en-GB", "fr-FR"}, "fr-FR"},
+		{"*;q=0.1, de", []string{"en", "de"}, "de"},
+		{"*", []string{"en", "de"}, "en"},
+
+		// The longest matching range decides
+		{"en, en-gb;q=0", []string{"en-GB", "en-US"}, "en-US"},
+		{"en-us;q=0.2, en", []string{"en-US", "en-GB"}, "en-GB"},
+		{"e", []string{"en"}, ""},
+	})
+}
+
+func TestCharset(t *testing.T) {
+	checkNegotiation(t, "Accept-Charset", Charset, []negotiation{
+		{"-", []string{"utf-8", "iso-8859-1"}, "utf-8"},
+		{"iso-8859-1", []string{"utf-8", "iso-8859-1"}, "iso-8859-1"},
+		{"UTF-8;q=0.5, iso-8859-1", []string{"utf-8", "iso-8859-1"}, "iso-8859-1"},
+		{"*", []string{"utf-8"}, "utf-8"},
+		{"*, utf-8;q=0", []string{"utf-8", "utf-16"}, "utf-16"},
+		{"utf-16", []string{"utf-8"}, ""},
+	})
+}
@@ -17,6 +17,7 @@ var OutputPipe Pipe = func(conn *Conn, req *http.Request) bool {
 	// Since we have ownership of the Conn object, we can finalize the
 	// response and then write it to the wire
 
+	conn.startResponse()
 	conn.rwriter.WriteHeader(conn.status)
 	if conn.body != nil {
 		written, err := io.Copy(conn.rwriter, conn.body)
@@ -25,6 +26,7 @@ var OutputPipe Pipe = func(conn *Conn, req *http.Request) bool {
 		conn.written = written
 		conn.body.Close()
 	}
+	conn.writeTrailers()
 
 	if flusher, ok := conn.rwriter.(http.Flusher); ok{
 		flusher.Flush()
@@ -42,6 +44,7 @@ var HTTP10KeepaliveOutputPipe Pipe = func(conn *Conn, req *http.Request) bool {
 	// Since we have ownership of the Conn object, we can finalize the
 	// response and then write it to the wire
 
+	conn.startResponse()
 	var reader io.Reader = conn.body
 
 	if conn.body != nil {
@@ -73,6 +76,7 @@ var HTTP10KeepaliveOutputPipe Pipe = func(conn *Conn, req *http.Request) bool {
 		conn.written = written
 		conn.body.Close()
 	}
+	conn.writeTrailers()
 
 	if flusher, ok := conn.rwriter.(http.Flusher); ok{
 		flusher.Flush()
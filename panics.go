@@ -0,0 +1,125 @@
+package webpipes
+
+import "fmt"
+import "log"
+import "net/http"
+import "reflect"
+import "runtime"
+import "runtime/debug"
+import "sync"
+
+//////////////////////////////////////////////////////////////////////////////
+// Panic recovery
+//
+// Chains are run inside net/http's own recovery, but networks and the content
+// goroutines spawned by components are not, so a single bad component could
+// take the whole server down. Instead, every call to HandleHTTPRequest made by
+// a chain or network, and every goroutine started with Conn.Go, recovers from
+// panics. The stack is logged along with the name of the component, the panic
+// is counted against that component, and the connection is given a 500 if
+// the response has not already been started.
+
+// The error given to the error handler when a component panics
+type PanicError struct {
+	Component string      // The name of the component that panicked
+	Value     interface{} // The value passed to panic
+	Stack     []byte      // The stack of the goroutine that panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("webpipes: panic in %s: %v", e.Component, e.Value)
+}
+
+var panicCounts struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+// Return the number of panics recovered so far, keyed by component name
+func PanicCounts() map[string]int64 {
+	panicCounts.Lock()
+	defer panicCounts.Unlock()
+
+	counts := make(map[string]int64, len(panicCounts.counts))
+	for name, count := range panicCounts.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+// Log and count a recovered panic
+func newPanicError(component string, value interface{}) *PanicError {
+	err := &PanicError{component, value, debug.Stack()}
+	log.Printf("%s\n%s", err, err.Stack)
+
+	panicCounts.Lock()
+	if panicCounts.counts == nil {
+		panicCounts.counts = make(map[string]int64)
+	}
+	panicCounts.counts[component]++
+	panicCounts.Unlock()
+
+	return err
+}
+
+// Return a name identifying a component in logs. Components can choose their
+// own name by implementing fmt.Stringer, otherwise functions are named after
+// the function and anything else after its type.
+func componentName(comp interface{}) string {
+	if stringer, ok := comp.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	value := reflect.ValueOf(comp)
+	if value.Kind() == reflect.Func {
+		if fn := runtime.FuncForPC(value.Pointer()); fn != nil {
+			return fn.Name()
+		}
+	}
+	return fmt.Sprintf("%T", comp)
+}
+
+// Run 'comp' on the connection, turning a panic into a *PanicError
+func callComponent(comp Component, conn *Conn, req *http.Request) (err error) {
+	name := componentName(comp)
+	conn.component = name
+
+	defer func() {
+		if value := recover(); value != nil {
+			err = newPanicError(name, value)
+		}
+	}()
+	return HandlerFor(comp).HandleConn(conn, req)
+}
+
+// Run 'fn' in a new goroutine on behalf of the current component. This should
+// be used instead of a plain go statement for any goroutine that produces or
+// transforms content, so that a panic can be recovered and charged to the
+// component responsible.
+func (c *Conn) Go(fn func()) {
+	component := c.component
+	go func() {
+		defer c.recoverContent(component)
+		fn()
+	}()
+}
+
+// Recover from a panic in a content goroutine. This must be deferred directly.
+//
+// If the response has not been started, the output pipe will send a 500
+// instead. Either way the content pipes are closed, so that nothing is left
+// waiting for the content that will now never arrive.
+func (c *Conn) recoverContent(component string) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	err := newPanicError(component, value)
+
+	c.mu.Lock()
+	if !c.wroteHeader {
+		c.panicked = err
+	}
+	c.mu.Unlock()
+
+	c.abortPipes(err)
+}
@@ -8,7 +8,9 @@ import "strings"
 import "time"
 
 // Require simple authentication in order to proceed, otherwise respond with
-// a challenge/denial and send the connection down the 'bypass' channel.
+// a challenge/denial and send the connection down the 'bypass' channel. If
+// 'bypass' is nil the challenge is written out directly instead, and the
+// rest of a Chain is skipped or the rest of a network passes it through.
 func SimpleAuth(users map[string]string, realm string, bypass chan<- *Conn) Pipe {
 	return func(conn *Conn, req *http.Request) bool {
 		// Check for the 'Authorization' header and attempt authentication
@@ -34,6 +36,7 @@ func SimpleAuth(users map[string]string, realm string, bypass chan<- *Conn) Pipe
 						pass, ok := users[username]
 						if ok && pass == password {
 							authenticated = true
+							conn.user = username
 						}
 					}
 				}
@@ -49,8 +52,7 @@ func SimpleAuth(users map[string]string, realm string, bypass chan<- *Conn) Pipe
 			// Pass the connection over the bypass channel and tell the component
 			// server to drop the connection, as we've already forwarded it on.
 			conn.HTTPStatusResponse(http.StatusUnauthorized)
-			bypass <- conn
-			return false
+			return bypassConn(conn, req, bypass)
 		}
 
 		// The user is authenticated, so proceed
@@ -64,6 +66,9 @@ func AccessLog(logger *log.Logger) Pipe {
 		var remoteHost = req.RemoteAddr // FIXME
 		var ident string = "-"
 		var authuser string = "-"
+		if conn.User() != "" {
+			authuser = conn.User()
+		}
 		var now time.Time = time.Now().UTC()
 		var timestamp string = now.Format("[07/Jan/2006:15:04:05 -0700]")
 		var request string = fmt.Sprintf("%s %s %s", req.Method, req.URL, req.Proto)
@@ -99,3 +104,19 @@ func DebugPipe(str string, args ...interface{}) Pipe {
 		return true
 	}
 }
+
+// Hand a connection that already has its response prepared to 'bypass', or
+// write the response out directly if there is no bypass channel. Either way
+// the caller is no longer responsible for the connection, so this returns
+// false for the component to pass on. A connection written out directly is
+// marked as delivered, so that in a network it still travels on to the end
+// to be finished.
+func bypassConn(conn *Conn, req *http.Request, bypass chan<- *Conn) bool {
+	if bypass == nil {
+		OutputPipe(conn, req)
+		conn.delivered = true
+	} else {
+		bypass <- conn
+	}
+	return false
+}
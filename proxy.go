@@ -0,0 +1,260 @@
+package webpipes
+
+import "context"
+import "errors"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "net/url"
+import "strconv"
+import "strings"
+import "time"
+
+//////////////////////////////////////////////////////////////////////////////
+// Reverse proxying
+//
+// A proxy source forwards the request to an upstream server and streams the
+// response body into the content pipeline, so the filters that follow can
+// post-process it as they would the output of any other source. Headers that
+// only describe the connection a message arrived on are dropped in both
+// directions, and the upstream is told who the original client was by way of
+// the X-Forwarded-* headers.
+
+// Options for a proxy source
+type ProxyOptions struct {
+	// Chooses the upstream for each request. The path of the upstream URL
+	// is prefixed to the path of the request, and its query is merged with
+	// the query of the request. An error is answered with a 502.
+	Select func(*Conn, *http.Request) (*url.URL, error)
+
+	// Used to make the upstream requests, http.DefaultTransport if nil
+	Transport http.RoundTripper
+
+	// If not zero, how long to wait for the upstream to start responding
+	// before giving up with a 504
+	Timeout time.Duration
+}
+
+// Returned when the upstream takes longer than the timeout to respond
+var ErrUpstreamTimeout = errors.New("webpipes: upstream timed out")
+
+// Forward requests to 'target'
+func ProxySource(target *url.URL) Source {
+	return NewProxySource(ProxyOptions{
+		Select: func(*Conn, *http.Request) (*url.URL, error) {
+			return target, nil
+		},
+	})
+}
+
+// Create a proxy source configured with 'opts'. Requests are forwarded with
+// their bodies, and a failure to reach the upstream or to get a response
+// from it is answered with a 502 Bad Gateway, or with a 504 Gateway Timeout
+// if it took too long.
+func NewProxySource(opts ProxyOptions) Source {
+	return func(conn *Conn, req *http.Request, writer io.WriteCloser) bool {
+		target, err := opts.Select(conn, req)
+		if err != nil {
+			log.Printf("webpipes: no upstream for %s: %s", req.URL, err)
+			writer.Close()
+			conn.HTTPStatusResponse(http.StatusBadGateway)
+			return true
+		}
+
+		resp, err := proxyRoundTrip(conn, req, target, req.Body, &opts)
+		if err != nil {
+			writer.Close()
+			proxyError(conn, req, err)
+			return true
+		}
+		proxyResponse(conn, resp, writer)
+		return true
+	}
+}
+
+// Send 'req' to 'target' with the given body, returning the response once its
+// headers have arrived
+func proxyRoundTrip(conn *Conn, req *http.Request, target *url.URL, body io.ReadCloser, opts *ProxyOptions) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(conn.Context())
+	var timer *time.Timer
+	if opts.Timeout > 0 {
+		timer = time.AfterFunc(opts.Timeout, func() {
+			cancel(ErrUpstreamTimeout)
+		})
+	}
+
+	out := req.Clone(ctx)
+	out.RequestURI = ""
+	out.Close = false
+	out.Host = ""
+	out.URL.Scheme = target.Scheme
+	out.URL.Host = target.Host
+	out.URL.Path, out.URL.RawPath = joinURLPath(target, req.URL)
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		out.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+	} else {
+		out.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
+	if req.ContentLength == 0 {
+		out.Body = nil
+	} else {
+		out.Body = body
+	}
+
+	removeHopHeaders(out.Header)
+	if strings.Contains(strings.ToLower(req.Header.Get("Te")), "trailers") {
+		out.Header.Set("Te", "trailers")
+	}
+	if _, ok := out.Header["User-Agent"]; !ok {
+		// Stop the transport adding its own
+		out.Header.Set("User-Agent", "")
+	}
+	addForwardedHeaders(out.Header, req)
+
+	transport := opts.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(out)
+	if timer != nil && !timer.Stop() && err == nil {
+		// The timer fired as the response arrived
+		resp.Body.Close()
+		err = ErrUpstreamTimeout
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); cause == ErrUpstreamTimeout {
+			err = cause
+		}
+		cancel(nil)
+		return nil, err
+	}
+
+	// Release the context once the body has been read
+	resp.Body = &cancelBody{resp.Body, func() { cancel(nil) }}
+	return resp, nil
+}
+
+// Send the upstream response 'resp' down the pipeline
+func proxyResponse(conn *Conn, resp *http.Response, writer io.WriteCloser) {
+	header := conn.rwriter.Header()
+	for key, values := range resp.Header {
+		header[key] = append([]string(nil), values...)
+	}
+	removeHopHeaders(header)
+	if resp.ContentLength >= 0 {
+		conn.SetHeader("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	for key := range resp.Trailer {
+		key := key
+		conn.Trailer(key, func() string {
+			return strings.Join(resp.Trailer.Values(key), ", ")
+		})
+	}
+	conn.SetStatus(resp.StatusCode)
+
+	conn.Go(func() {
+		_, err := io.Copy(writer, resp.Body)
+		resp.Body.Close()
+		if err != nil && conn.Context().Err() == nil {
+			log.Printf("webpipes: error reading upstream response for %s: %s", conn.Request.URL, err)
+		}
+		writer.Close()
+	})
+}
+
+// Answer the request with the status that describes an upstream failure
+func proxyError(conn *Conn, req *http.Request, err error) {
+	if conn.Context().Err() != nil {
+		// The client has gone away, so nobody is listening
+		return
+	}
+
+	status := http.StatusBadGateway
+	var netErr net.Error
+	if err == ErrUpstreamTimeout || errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		status = http.StatusGatewayTimeout
+	}
+	log.Printf("webpipes: upstream error for %s: %s", req.URL, err)
+	conn.HTTPStatusResponse(status)
+}
+
+// Headers that apply to a single connection, and are not passed on by
+// proxies, as listed by RFC 9110 along with some older ones
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Remove the hop-by-hop headers from 'header', including any named by the
+// Connection header
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				header.Del(field)
+			}
+		}
+	}
+	for _, field := range hopHeaders {
+		header.Del(field)
+	}
+}
+
+// Tell the upstream about the client and the address it used
+func addForwardedHeaders(header http.Header, req *http.Request) {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		header.Set("X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+	header.Set("X-Forwarded-Host", req.Host)
+}
+
+// Join the paths of the upstream and the request, returning the path and its
+// raw form as url.URL expects them
+func joinURLPath(target, reqURL *url.URL) (string, string) {
+	if target.RawPath == "" && reqURL.RawPath == "" {
+		return singleJoiningSlash(target.Path, reqURL.Path), ""
+	}
+	path := singleJoiningSlash(target.Path, reqURL.Path)
+	rawPath := singleJoiningSlash(target.EscapedPath(), reqURL.EscapedPath())
+	return path, rawPath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && b != "":
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// A response body that runs a function once it has been closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
@@ -0,0 +1,419 @@
+package webpipes
+
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "mime/multipart"
+import "net/http"
+import "net/textproto"
+import "strconv"
+import "strings"
+import "time"
+
+//////////////////////////////////////////////////////////////////////////////
+// Conditional and range requests
+//
+// Both of these depend on exactly which bytes end up being sent, so rather
+// than acting when they are reached in the pipeline they register a function
+// with BeforeOutput and make their decision once every other component has
+// run. If a later component changes the representation, for instance by
+// compressing it, the validators and byte offsets supplied by the source no
+// longer describe what is sent and both components stand aside.
+//
+// The functions run in the order the components were placed in, so where
+// they are placed matters. Preconditions are evaluated before the Range
+// header, as RFC 9110 requires, whichever comes first: RangePipe stands aside
+// when a precondition fails, leaving ConditionalPipe or ETagFilter to answer.
+// RangePipe should still come after ETagFilter, since a range served first
+// changes the representation and ETagFilter would then weaken its tag.
+
+// Evaluate the preconditions of the request (If-Match, If-Unmodified-Since,
+// If-None-Match and If-Modified-Since) against the ETag and Last-Modified
+// headers of the response, in the order set out by RFC 9110. A failed
+// If-None-Match or If-Modified-Since on a GET or HEAD is answered with 304 Not
+// Modified and no body, other failures with 412 Precondition Failed. Place it
+// after the source, and before any filters that change the content.
+var ConditionalPipe Pipe = func(conn *Conn, req *http.Request) bool {
+	representation := conn.Representation()
+	conn.BeforeOutput(func() {
+		if conn.Representation() != representation {
+			return
+		}
+		if conn.status < 200 || conn.status > 299 {
+			return
+		}
+
+		switch checkPreconditions(conn, req) {
+		case http.StatusNotModified:
+			notModified(conn)
+		case http.StatusPreconditionFailed:
+			conn.HTTPStatusResponse(http.StatusPreconditionFailed)
+		}
+	})
+	return true
+}
+
+// Return the status the preconditions of 'req' call for, or 0 if the request
+// should be carried out as normal
+func checkPreconditions(conn *Conn, req *http.Request) int {
+	etag := conn.GetHeader("ETag")
+	lastModified, modErr := http.ParseTime(conn.GetHeader("Last-Modified"))
+	getOrHead := req.Method == "GET" || req.Method == "HEAD"
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatch(ifMatch, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := req.Header.Get("If-Unmodified-Since"); ius != "" && modErr == nil {
+		if t, err := http.ParseTime(ius); err == nil && lastModified.Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatch(ifNoneMatch, etag, false) {
+			if getOrHead {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := req.Header.Get("If-Modified-Since"); ims != "" && getOrHead && modErr == nil {
+		if t, err := http.ParseTime(ims); err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// Turn the response into a 304 Not Modified, dropping the body and the
+// headers that describe it, as http.ServeContent does
+func notModified(conn *Conn) {
+	conn.discardContent()
+	conn.DelHeader("Content-Type")
+	conn.DelHeader("Content-Length")
+	conn.DelHeader("Content-Encoding")
+	if conn.GetHeader("ETag") != "" {
+		conn.DelHeader("Last-Modified")
+	}
+	conn.SetStatus(http.StatusNotModified)
+	conn.ChangeRepresentation()
+}
+
+// Serve the byte ranges asked for by the Range header of GET requests, as a
+// single 206 Partial Content response or as multipart/byteranges when several
+// ranges are requested, and answer ranges that lie beyond the end of the
+// content with 416 Range Not Satisfiable. If-Range is honoured using the ETag
+// or Last-Modified header of the response.
+//
+// The length of the content is taken from the Content-Length header. Without
+// one, up to 'maxBuffer' bytes are read ahead to find it, and larger content
+// is sent whole. Requests for overlapping or out of order ranges are also
+// answered with the whole content, which RFC 9110 permits. Requests whose
+// preconditions fail are left alone, for ConditionalPipe to answer.
+func RangePipe(maxBuffer int64) Pipe {
+	return func(conn *Conn, req *http.Request) bool {
+		representation := conn.Representation()
+		conn.BeforeOutput(func() {
+			if conn.Representation() != representation || conn.status != http.StatusOK {
+				return
+			}
+
+			conn.SetHeader("Accept-Ranges", "bytes")
+			spec := req.Header.Get("Range")
+			if req.Method != "GET" || spec == "" || !ifRangeValid(conn, req) {
+				return
+			}
+			if checkPreconditions(conn, req) != 0 {
+				return
+			}
+
+			reader := conn.NewContentReader()
+			if reader == nil {
+				return
+			}
+			reader, size, ok := contentSize(conn, reader, maxBuffer)
+			conn.body = reader
+			if !ok {
+				return
+			}
+
+			ranges, err := parseRanges(spec, size)
+			switch {
+			case err == errUnsatisfiableRange:
+				conn.HTTPStatusResponse(http.StatusRequestedRangeNotSatisfiable)
+				conn.SetHeader("Content-Range", fmt.Sprintf("bytes */%d", size))
+			case err == nil:
+				serveRanges(conn, ranges, size)
+			}
+		})
+		return true
+	}
+}
+
+// Return the length of the content, reading up to 'limit' bytes ahead when
+// there is no Content-Length header, along with a reader for the whole of
+// the content. The length is only known if the last result is true.
+func contentSize(conn *Conn, reader io.ReadCloser, limit int64) (io.ReadCloser, int64, bool) {
+	if length := conn.GetHeader("Content-Length"); length != "" {
+		size, err := strconv.ParseInt(length, 10, 64)
+		return reader, size, err == nil && size >= 0
+	}
+
+	data, complete := readAhead(reader, limit)
+	rest := &prefixReader{io.MultiReader(bytes.NewReader(data), reader), reader}
+	if !complete {
+		// Either the content is too large, or it could not be read
+		return rest, 0, false
+	}
+	return rest, int64(len(data)), true
+}
+
+// Read up to 'limit' bytes from 'reader', returning what was read and whether
+// it is the whole of the content. The buffer grows as the content is read,
+// so that small content does not pay for a large limit.
+func readAhead(reader io.Reader, limit int64) ([]byte, bool) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(io.LimitReader(reader, limit+1))
+	return buf.Bytes(), err == nil && int64(buf.Len()) <= limit
+}
+
+// Check whether the If-Range header, if any, still describes the content,
+// in which case the range may be served
+func ifRangeValid(conn *Conn, req *http.Request) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagStrongMatch(ifRange, conn.GetHeader("ETag"))
+	}
+	lastModified, err := http.ParseTime(conn.GetHeader("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Equal(lastModified)
+}
+
+// A range of bytes within the content
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+var errUnsatisfiableRange = errors.New("webpipes: no range is satisfiable")
+var errUnusableRange = errors.New("webpipes: ranges cannot be served")
+
+// Parse a Range header for content of 'size' bytes. Ranges that start beyond
+// the end of the content are dropped, and if none remain the result is
+// errUnsatisfiableRange. Any other error means the header should be ignored.
+func parseRanges(spec string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if len(spec) < len(prefix) || !strings.EqualFold(spec[:len(prefix)], prefix) {
+		return nil, errUnusableRange
+	}
+
+	var ranges []byteRange
+	for _, part := range strings.Split(spec[len(prefix):], ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, found := strings.Cut(part, "-")
+		if !found {
+			return nil, errUnusableRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// A suffix range, for the last bytes of the content
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errUnusableRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errUnusableRange
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errUnusableRange
+				}
+				if end > size-1 {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start, end - start + 1}
+		}
+
+		if len(ranges) > 0 {
+			prev := ranges[len(ranges)-1]
+			if r.start < prev.start+prev.length {
+				return nil, errUnusableRange
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// Replace the content with the given ranges of it
+func serveRanges(conn *Conn, ranges []byteRange, size int64) {
+	reader := conn.NewContentReader()
+	writer := conn.NewContentWriter()
+	conn.SetStatus(http.StatusPartialContent)
+	conn.ChangeRepresentation()
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		conn.SetHeader("Content-Range", r.contentRange(size))
+		conn.SetHeader("Content-Length", strconv.FormatInt(r.length, 10))
+		conn.Go(func() {
+			if _, err := io.CopyN(io.Discard, reader, r.start); err == nil {
+				io.CopyN(writer, reader, r.length)
+			}
+			reader.Close()
+			writer.Close()
+		})
+		return
+	}
+
+	contentType := conn.GetHeader("Content-Type")
+	parts := make([]textproto.MIMEHeader, len(ranges))
+	for i, r := range ranges {
+		parts[i] = textproto.MIMEHeader{"Content-Range": {r.contentRange(size)}}
+		if contentType != "" {
+			parts[i].Set("Content-Type", contentType)
+		}
+	}
+
+	// Work out the length of the multipart body by writing it without the
+	// content
+	counter := &countingWriter{}
+	mw := multipart.NewWriter(counter)
+	for i, r := range ranges {
+		mw.CreatePart(parts[i])
+		counter.n += r.length
+	}
+	mw.Close()
+
+	conn.SetHeader("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	conn.SetHeader("Content-Length", strconv.FormatInt(counter.n, 10))
+	conn.Go(func() {
+		out := multipart.NewWriter(writer)
+		out.SetBoundary(mw.Boundary())
+		var pos int64
+		for i, r := range ranges {
+			if _, err := io.CopyN(io.Discard, reader, r.start-pos); err != nil {
+				break
+			}
+			part, err := out.CreatePart(parts[i])
+			if err != nil {
+				break
+			}
+			if _, err := io.CopyN(part, reader, r.length); err != nil {
+				break
+			}
+			pos = r.start + r.length
+		}
+		out.Close()
+		reader.Close()
+		writer.Close()
+	})
+}
+
+// A writer that counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	cw.n += int64(len(b))
+	return len(b), nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Entity tags
+
+// Report whether 'etag' matches any of the entity tags in the If-Match or
+// If-None-Match header 'list'. A list of "*" matches any current
+// representation. If-Match uses the strong comparison, If-None-Match the
+// weak one.
+func etagListMatch(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range parseETags(list) {
+		if strong && etagStrongMatch(candidate, etag) {
+			return true
+		}
+		if !strong && etagWeakMatch(candidate, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split a comma separated list of entity tags. Commas may appear inside an
+// entity tag, so the list cannot simply be split on them.
+func parseETags(list string) []string {
+	var etags []string
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return etags
+		}
+
+		start := 0
+		if strings.HasPrefix(list, "W/") {
+			start = 2
+		}
+		if len(list) <= start || list[start] != '"' {
+			// Not an entity tag, skip to the next element
+			_, list, _ = strings.Cut(list, ",")
+			continue
+		}
+		end := strings.IndexByte(list[start+1:], '"')
+		if end < 0 {
+			return etags
+		}
+		end += start + 2
+		etags = append(etags, list[:end])
+		list = list[end:]
+	}
+}
+
+// Entity tags match strongly if neither is weak and they are identical
+func etagStrongMatch(a, b string) bool {
+	return a != "" && a == b && !strings.HasPrefix(a, "W/")
+}
+
+// Entity tags match weakly if they are identical once any weakness
+// indicator is ignored
+func etagWeakMatch(a, b string) bool {
+	a = strings.TrimPrefix(a, "W/")
+	b = strings.TrimPrefix(b, "W/")
+	return a != "" && a == b
+}
@@ -0,0 +1,204 @@
+package webpipes
+
+import "io"
+import "mime"
+import "mime/multipart"
+import "net/http"
+import "net/http/httptest"
+import "strconv"
+import "strings"
+import "testing"
+import "time"
+
+const rangeContent = "abcdefghijklmnopqrstuvwxyz"
+
+var rangeModified = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// Give the response validators, and a Content-Length if 'length' is set
+func rangeValidators(length bool) Pipe {
+	return func(conn *Conn, req *http.Request) bool {
+		conn.SetHeader("ETag", `"v1"`)
+		conn.SetHeader("Last-Modified", rangeModified.Format(http.TimeFormat))
+		if length {
+			conn.SetHeader("Content-Length", "26")
+		}
+		return true
+	}
+}
+
+type rangeTest struct {
+	name         string
+	method       string
+	header       http.Header
+	status       int
+	body         string // the expected body, unless empty
+	contentRange string // the expected Content-Range, unless empty
+}
+
+func checkRanges(t *testing.T, handler http.Handler, tests []rangeTest) {
+	t.Helper()
+	for _, test := range tests {
+		method := test.method
+		if method == "" {
+			method = "GET"
+		}
+		req := httptest.NewRequest(method, "/", nil)
+		for key, values := range test.header {
+			req.Header[key] = values
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, rec.Code, test.status)
+			continue
+		}
+		if test.body != "" && rec.Body.String() != test.body {
+			t.Errorf("%s: body %q, want %q", test.name, rec.Body, test.body)
+		}
+		if got := rec.Header().Get("Content-Range"); test.contentRange != "" && got != test.contentRange {
+			t.Errorf("%s: Content-Range %q, want %q", test.name, got, test.contentRange)
+		}
+		if test.status == http.StatusNotModified && rec.Body.Len() > 0 {
+			t.Errorf("%s: 304 with a body of %d bytes", test.name, rec.Body.Len())
+		}
+	}
+}
+
+func ranges(spec string) http.Header {
+	return http.Header{"Range": {spec}}
+}
+
+func TestRangePipe(t *testing.T) {
+	tests := []rangeTest{
+		{"no range", "", nil, 200, rangeContent, ""},
+		{"first bytes", "", ranges("bytes=0-4"), 206, "abcde", "bytes 0-4/26"},
+		{"open ended", "", ranges("bytes=20-"), 206, "uvwxyz", "bytes 20-25/26"},
+		{"past the end", "", ranges("bytes=24-100"), 206, "yz", "bytes 24-25/26"},
+		{"suffix", "", ranges("bytes=-3"), 206, "xyz", "bytes 23-25/26"},
+		{"long suffix", "", ranges("bytes=-100"), 206, rangeContent, "bytes 0-25/26"},
+		{"case and spaces", "", ranges("Bytes= 1 - 2 "), 206, "bc", "bytes 1-2/26"},
+		{"drops unsatisfiable", "", ranges("bytes=30-40, 0-2"), 206, "abc", "bytes 0-2/26"},
+		{"unsatisfiable", "", ranges("bytes=26-"), 416, "", "bytes */26"},
+		{"empty suffix", "", ranges("bytes=-0"), 416, "", "bytes */26"},
+		{"overlapping", "", ranges("bytes=0-5,3-8"), 200, rangeContent, ""},
+		{"out of order", "", ranges("bytes=5-7,0-2"), 200, rangeContent, ""},
+		{"other unit", "", ranges("items=0-4"), 200, rangeContent, ""},
+		{"malformed", "", ranges("bytes=4-2"), 200, rangeContent, ""},
+		{"not a GET", "POST", ranges("bytes=0-4"), 200, rangeContent, ""},
+		{"HEAD", "HEAD", ranges("bytes=0-4"), 200, "", ""},
+
+		{"If-Range etag", "", http.Header{"Range": {"bytes=0-1"}, "If-Range": {`"v1"`}}, 206, "ab", ""},
+		{"If-Range old etag", "", http.Header{"Range": {"bytes=0-1"}, "If-Range": {`"v0"`}}, 200, rangeContent, ""},
+		{"If-Range weak etag", "", http.Header{"Range": {"bytes=0-1"}, "If-Range": {`W/"v1"`}}, 200, rangeContent, ""},
+		{"If-Range date", "", http.Header{"Range": {"bytes=0-1"}, "If-Range": {rangeModified.Format(http.TimeFormat)}}, 206, "ab", ""},
+		{"If-Range old date", "", http.Header{"Range": {"bytes=0-1"}, "If-Range": {rangeModified.Add(-time.Hour).Format(http.TimeFormat)}}, 200, rangeContent, ""},
+	}
+
+	for _, length := range []bool{false, true} {
+		checkRanges(t, Chain(TextStringSource(rangeContent), rangeValidators(length), RangePipe(1<<10), OutputPipe), tests)
+	}
+}
+
+func TestRangePipeMultipart(t *testing.T) {
+	chain := Chain(TextStringSource(rangeContent), RangePipe(1<<10), OutputPipe)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=0-2, 10-11, -2")
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want 206", rec.Code)
+	}
+	if got, want := rec.Header().Get("Content-Length"), len(rec.Body.String()); got != strconv.Itoa(want) {
+		t.Errorf("Content-Length %s, body of %d bytes", got, want)
+	}
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type %q", rec.Header().Get("Content-Type"))
+	}
+
+	want := []struct{ body, contentRange string }{
+		{"abc", "bytes 0-2/26"},
+		{"kl", "bytes 10-11/26"},
+		{"yz", "bytes 24-25/26"},
+	}
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("%d parts, want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil || i >= len(want) {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(part)
+		if string(body) != want[i].body || part.Header.Get("Content-Range") != want[i].contentRange {
+			t.Errorf("part %d: %q with range %q", i, body, part.Header.Get("Content-Range"))
+		}
+		if ct := part.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("part %d: Content-Type %q", i, ct)
+		}
+	}
+}
+
+func TestRangePipeLargeContent(t *testing.T) {
+	// Content larger than the buffer, with no Content-Length, is sent whole
+	chain := Chain(TextStringSource(rangeContent), RangePipe(10), OutputPipe)
+	checkRanges(t, chain, []rangeTest{
+		{"large content", "", ranges("bytes=0-4"), 200, rangeContent, ""},
+	})
+}
+
+func TestConditionalPipe(t *testing.T) {
+	before := rangeModified.Add(-time.Hour).Format(http.TimeFormat)
+	at := rangeModified.Format(http.TimeFormat)
+	after := rangeModified.Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []rangeTest{
+		{"unconditional", "", nil, 200, rangeContent, ""},
+		{"If-None-Match", "", http.Header{"If-None-Match": {`"v1"`}}, 304, "", ""},
+		{"If-None-Match weak", "", http.Header{"If-None-Match": {`"v0", W/"v1"`}}, 304, "", ""},
+		{"If-None-Match star", "", http.Header{"If-None-Match": {"*"}}, 304, "", ""},
+		{"If-None-Match other", "", http.Header{"If-None-Match": {`"v0"`}}, 200, rangeContent, ""},
+		{"If-None-Match POST", "POST", http.Header{"If-None-Match": {`"v1"`}}, 412, "", ""},
+		{"If-Match", "", http.Header{"If-Match": {`"v1"`}}, 200, rangeContent, ""},
+		{"If-Match other", "", http.Header{"If-Match": {`"v0"`}}, 412, "", ""},
+		{"If-Match weak", "", http.Header{"If-Match": {`W/"v1"`}}, 412, "", ""},
+		{"If-Modified-Since now", "", http.Header{"If-Modified-Since": {at}}, 304, "", ""},
+		{"If-Modified-Since later", "", http.Header{"If-Modified-Since": {after}}, 304, "", ""},
+		{"If-Modified-Since earlier", "", http.Header{"If-Modified-Since": {before}}, 200, rangeContent, ""},
+		{"If-Modified-Since POST", "POST", http.Header{"If-Modified-Since": {after}}, 200, rangeContent, ""},
+		{"If-Unmodified-Since earlier", "", http.Header{"If-Unmodified-Since": {before}}, 412, "", ""},
+		{"If-Unmodified-Since now", "", http.Header{"If-Unmodified-Since": {at}}, 200, rangeContent, ""},
+
+		// An etag condition takes the place of a date
+		{"If-None-Match over date", "", http.Header{"If-None-Match": {`"v0"`}, "If-Modified-Since": {after}}, 200, rangeContent, ""},
+		{"If-Match over date", "", http.Header{"If-Match": {`"v1"`}, "If-Unmodified-Since": {before}}, 200, rangeContent, ""},
+
+		// Preconditions come before ranges
+		{"range If-None-Match", "", http.Header{"Range": {"bytes=0-1"}, "If-None-Match": {`"v1"`}}, 304, "", ""},
+		{"range If-Match", "", http.Header{"Range": {"bytes=0-1"}, "If-Match": {`"v0"`}}, 412, "", ""},
+		{"range If-Match passes", "", http.Header{"Range": {"bytes=0-1"}, "If-Match": {`"v1"`}}, 206, "ab", ""},
+	}
+
+	// The result should not depend on the order of the components
+	source, validators := TextStringSource(rangeContent), rangeValidators(false)
+	checkRanges(t, Chain(source, validators, ConditionalPipe, RangePipe(1<<10), OutputPipe), tests)
+	checkRanges(t, Chain(source, validators, RangePipe(1<<10), ConditionalPipe, OutputPipe), tests)
+}
+
+func TestConditionalPipeErrors(t *testing.T) {
+	// Preconditions only apply to successful responses
+	failing := Pipe(func(conn *Conn, req *http.Request) bool {
+		conn.HTTPStatusResponse(http.StatusNotFound)
+		return true
+	})
+	chain := Chain(TextStringSource(rangeContent), rangeValidators(false), failing, ConditionalPipe, RangePipe(1<<10), OutputPipe)
+	checkRanges(t, chain, []rangeTest{
+		{"not found", "", http.Header{"If-None-Match": {`"v1"`}, "Range": {"bytes=0-1"}}, 404, "", ""},
+	})
+}
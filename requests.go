@@ -0,0 +1,376 @@
+package webpipes
+
+import "bufio"
+import "bytes"
+import "compress/flate"
+import "compress/gzip"
+import "compress/zlib"
+import "context"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+//////////////////////////////////////////////////////////////////////////////
+// Request body filters
+//
+// Filters operate on the response, but sometimes the body of the request
+// needs to be transformed before a source such as CGIServer reads it. A
+// RequestFilter is given the current request body and returns the body that
+// should replace it, usually by wrapping the one it was given so that the
+// work is done as the source reads. A RequestStreamFilter instead copies the
+// body through a pipe, in the same way that a Filter does for the response,
+// using Conn.NewRequestReader and Conn.NewRequestWriter.
+
+type RequestFilter func(*Conn, *http.Request, io.ReadCloser) (io.ReadCloser, error)
+
+func (fn RequestFilter) HandleConn(c *Conn, req *http.Request) error {
+	reader := c.NewRequestReader()
+	if reader == nil {
+		return ErrNoRequestReader
+	}
+	body, err := fn(c, req, reader)
+	if err != nil {
+		c.setRequestBody(req, reader)
+		return err
+	}
+	c.setRequestBody(req, body)
+	return nil
+}
+
+func (fn RequestFilter) HandleHTTPRequest(c *Conn, req *http.Request) bool {
+	return handleResult(c, fn.HandleConn(c, req))
+}
+
+// A RequestStreamFilter is the request side equivalent of a Filter. It reads
+// the request body from the reader and writes the body that sources should
+// see to the writer, which it should do in a goroutine started with Conn.Go
+// after it has returned.
+
+type RequestStreamFilter func(*Conn, *http.Request, io.ReadCloser, io.WriteCloser) bool
+
+func (fn RequestStreamFilter) HandleConn(c *Conn, req *http.Request) error {
+	// Allocate a new request reader/writer for the filter
+	reader := c.NewRequestReader()
+	if reader == nil {
+		return ErrNoRequestReader
+	}
+	writer := c.NewRequestWriter()
+	req.Body = c.Request.Body
+	req.ContentLength = c.Request.ContentLength
+	req.Header.Del("Content-Length")
+
+	if !fn(c, req, reader, writer) {
+		return ErrHandled
+	}
+	return nil
+}
+
+func (fn RequestStreamFilter) HandleHTTPRequest(c *Conn, req *http.Request) bool {
+	return handleResult(c, fn.HandleConn(c, req))
+}
+
+// Returned when a component asks for the request body after another component
+// has taken it without providing a replacement
+var ErrNoRequestReader = errors.New("webpipes: no request reader available")
+
+// Returned when reading a request body that is larger than allowed
+var ErrBodyTooLarge = &StatusError{http.StatusRequestEntityTooLarge, errors.New("request body too large")}
+
+// Transparently decode request bodies sent with a Content-Encoding of gzip or
+// deflate, so that sources see the original content. The body is decoded
+// before it is passed on, so that it can be given a Content-Length, which
+// sources such as CGIServer need. A body of more than 'limit' bytes once
+// decoded is refused with a 413, which guards against small bodies that
+// decompress to something enormous. Requests with any other encoding are
+// refused with a 415, and bodies that cannot be decoded with a 400. Large
+// bodies are decoded to a temporary file, which is removed once the
+// connection is done with.
+func DecompressRequest(limit int64) RequestFilter {
+	return func(conn *Conn, req *http.Request, body io.ReadCloser) (io.ReadCloser, error) {
+		encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+
+		var decoded io.Reader
+		switch encoding {
+		case "", "identity":
+			return body, nil
+		case "gzip", "x-gzip":
+			zipr, err := gzip.NewReader(body)
+			if err != nil {
+				return nil, &StatusError{http.StatusBadRequest, err}
+			}
+			decoded = zipr
+		case "deflate":
+			decoded = newDeflateReader(body)
+		default:
+			err := fmt.Errorf("unsupported request Content-Encoding %q", encoding)
+			return nil, &StatusError{http.StatusUnsupportedMediaType, err}
+		}
+
+		spooled, length, err := spoolBody(decoded, limit)
+		body.Close()
+		if err == ErrBodyTooLarge {
+			return nil, err
+		} else if err != nil {
+			return nil, &StatusError{http.StatusBadRequest, err}
+		}
+		// Sources don't close the request body, and net/http only closes the
+		// one it created
+		context.AfterFunc(conn.Context(), func() {
+			spooled.Close()
+		})
+
+		req.Header.Del("Content-Encoding")
+		req.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+		req.ContentLength = length
+		return spooled, nil
+	}
+}
+
+// Bodies up to this size are spooled in memory, larger ones to a file
+const spoolMemory = 1 << 20
+
+// Read the whole of 'body' so that its length is known, keeping it in memory
+// if it is small and in a temporary file otherwise. Reading more than 'limit'
+// bytes fails with ErrBodyTooLarge, unless 'limit' is negative. The body
+// that is returned removes the file when it is closed.
+func spoolBody(body io.Reader, limit int64) (io.ReadCloser, int64, error) {
+	if limit >= 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, body, spoolMemory+1)
+	if err == io.EOF {
+		if limit >= 0 && n > limit {
+			return nil, 0, ErrBodyTooLarge
+		}
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), n, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.CreateTemp("", "webpipes-body-")
+	if err != nil {
+		return nil, 0, err
+	}
+	spooled := &spooledFile{file}
+	n, err = io.Copy(file, io.MultiReader(&buf, body))
+	if err == nil && limit >= 0 && n > limit {
+		err = ErrBodyTooLarge
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, 0, err
+	}
+	return spooled, n, nil
+}
+
+// The largest body of unknown length that the gateway sources read in full
+// unless they are told otherwise
+const defaultMaxSpooledBody = 32 << 20
+
+// Read the body of a request of unknown length in full, for sources that must
+// tell the application its length up front, and give the request the spooled
+// body and its length. A body of more than 'limit' bytes is refused with
+// ErrBodyTooLarge, unless 'limit' is negative. The spooled body is removed
+// once the connection is done with. An error reading the body carries the
+// status to answer with.
+func spoolRequest(conn *Conn, req *http.Request, limit int64) error {
+	if req.ContentLength >= 0 {
+		return nil
+	}
+	body, length, err := spoolBody(req.Body, limit)
+	if err != nil {
+		var serr *StatusError
+		if !errors.As(err, &serr) {
+			err = &StatusError{http.StatusBadRequest, err}
+		}
+		return err
+	}
+	context.AfterFunc(conn.Context(), func() {
+		body.Close()
+	})
+
+	conn.setRequestBody(req, body)
+	req.ContentLength = length
+	req.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	return nil
+}
+
+// A spooled request body, which is removed once it has been read
+type spooledFile struct {
+	*os.File
+}
+
+func (sf *spooledFile) Close() error {
+	err := sf.File.Close()
+	os.Remove(sf.Name())
+	return err
+}
+
+// The deflate content coding is meant to be zlib wrapped, but some clients
+// send a raw deflate stream, so look at the first two bytes to tell them
+// apart.
+func newDeflateReader(r io.Reader) io.Reader {
+	buf := bufio.NewReader(r)
+	header, err := buf.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		if zlibr, err := zlib.NewReader(buf); err == nil {
+			return zlibr
+		}
+	}
+	return flate.NewReader(buf)
+}
+
+// A request body that fails once more than a given number of bytes have been
+// read from it
+type limitedBody struct {
+	reader    io.Reader
+	remaining int64
+	source    io.Closer
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// Read one byte more than allowed, so that a body of exactly the limit
+	// can be told apart from one that is too large
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.reader.Read(p)
+	lb.remaining -= int64(n)
+	if lb.remaining < 0 {
+		return n + int(lb.remaining), ErrBodyTooLarge
+	}
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	return lb.source.Close()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Request body limits
+
+// Refuse request bodies larger than 'n' bytes. A request that declares a
+// larger Content-Length is answered with a 413 straight away, and sent down
+// the 'bypass' channel (or written out directly if 'bypass' is nil). Bodies
+// of unknown length are cut off with ErrBodyTooLarge once the limit has been
+// read. It must come before a source such as CGIServer or FastCGIServer to
+// limit what the source reads, since they only limit bodies of unknown
+// length themselves.
+func MaxBodySize(n int64, bypass chan<- *Conn) Pipe {
+	return func(conn *Conn, req *http.Request) bool {
+		if req.ContentLength > n {
+			conn.HTTPStatusResponse(http.StatusRequestEntityTooLarge)
+			return bypassConn(conn, req, bypass)
+		}
+
+		body := conn.NewRequestReader()
+		if body == nil {
+			conn.HTTPStatusResponse(http.StatusInternalServerError)
+			return true
+		}
+		conn.setRequestBody(req, &limitedBody{body, n, body})
+		return true
+	}
+}
+
+// Returned when reading a request body would take a user over their quota
+var ErrQuotaExceeded = &StatusError{http.StatusRequestEntityTooLarge, errors.New("upload quota exceeded")}
+
+// A limit on the number of bytes of request body that each user can upload
+// in a day, where users are identified by Conn.User. The count is reset at
+// midnight UTC.
+type UploadQuota struct {
+	limit int64
+	mu    sync.Mutex
+	day   string
+	used  map[string]int64
+}
+
+// Create a quota allowing each user to upload 'limit' bytes a day
+func NewUploadQuota(limit int64) *UploadQuota {
+	return &UploadQuota{limit: limit, used: make(map[string]int64)}
+}
+
+// Return the number of bytes 'user' has uploaded today
+func (q *UploadQuota) Used(user string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	return q.used[user]
+}
+
+// Forget usage from previous days. The mutex must be held.
+func (q *UploadQuota) rollover() {
+	today := time.Now().UTC().Format("2006-01-02")
+	if q.day != today {
+		q.day = today
+		q.used = make(map[string]int64)
+	}
+}
+
+// Charge 'n' bytes to 'user', returning false if that takes them over quota
+func (q *UploadQuota) charge(user string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	q.used[user] += n
+	return q.used[user] <= q.limit
+}
+
+// Return a pipe that enforces the quota. Requests that have not been
+// authenticated are let through without being counted, so this belongs
+// after an authentication component such as SimpleAuth. A request that
+// declares a Content-Length larger than the user has left is answered with a
+// 413 and sent down 'bypass' (or written out directly if 'bypass' is nil).
+// Otherwise the body is charged to the user as it is read, and reading fails
+// with ErrQuotaExceeded if the user runs out.
+func (q *UploadQuota) Pipe(bypass chan<- *Conn) Pipe {
+	return func(conn *Conn, req *http.Request) bool {
+		user := conn.User()
+		if user == "" {
+			return true
+		}
+
+		if req.ContentLength > 0 && q.Used(user)+req.ContentLength > q.limit {
+			conn.HTTPStatusResponse(http.StatusRequestEntityTooLarge)
+			return bypassConn(conn, req, bypass)
+		}
+
+		body := conn.NewRequestReader()
+		if body == nil {
+			conn.HTTPStatusResponse(http.StatusInternalServerError)
+			return true
+		}
+		conn.setRequestBody(req, &quotaBody{body, q, user})
+		return true
+	}
+}
+
+// A request body that charges what is read to a user's quota
+type quotaBody struct {
+	io.ReadCloser
+	quota *UploadQuota
+	user  string
+}
+
+func (qb *quotaBody) Read(p []byte) (int, error) {
+	n, err := qb.ReadCloser.Read(p)
+	if n > 0 && !qb.quota.charge(qb.user, int64(n)) {
+		return n, ErrQuotaExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,315 @@
+package webpipes
+
+import "bytes"
+import "compress/gzip"
+import "context"
+import "fmt"
+import "io"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "testing"
+import "time"
+
+// Write a CGI script that reports the length it was given and echoes its body
+func echoScript(t *testing.T) string {
+	script := filepath.Join(t.TempDir(), "echo.sh")
+	err := os.WriteFile(script, []byte("#!/bin/sh\n"+
+		"echo Content-Type: text/plain\n"+
+		"echo\n"+
+		"echo \"length=$CONTENT_LENGTH\"\n"+
+		"cat\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// Wait for the temporary files in 'dir' to be removed
+func checkSpoolRemoved(t *testing.T, dir string) {
+	t.Helper()
+	var entries []os.DirEntry
+	for i := 0; i < 100; i++ {
+		entries, _ = os.ReadDir(dir)
+		if len(entries) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%d spooled bodies left behind, including %s", len(entries), entries[0].Name())
+}
+
+func TestDecompressRequestCGI(t *testing.T) {
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	chain := Chain(DecompressRequest(4<<20), CGIServer(echoScript(t), "/"), OutputPipe)
+
+	for _, size := range []int{0, 100, 100000, spoolMemory + 100} {
+		content := strings.Repeat("x", size)
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(gzipBytes([]byte(content))))
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		chain.ServeHTTP(rec, req)
+
+		// As in net/http/cgi, CONTENT_LENGTH is only set when there is a body
+		length := ""
+		if size > 0 {
+			length = strconv.Itoa(size)
+		}
+		want := "length=" + length + "\n" + content
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%d bytes: status %d, body %.40q", size, rec.Code, rec.Body)
+		}
+	}
+	checkSpoolRemoved(t, spool)
+}
+
+func TestDecompressRequestLimit(t *testing.T) {
+	chain := Chain(DecompressRequest(1000), CGIServer(echoScript(t), "/"), OutputPipe)
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(gzipBytes(make([]byte, 1001))))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+}
+
+func TestSpoolBody(t *testing.T) {
+	for _, size := range []int{0, 10, spoolMemory, spoolMemory + 10} {
+		data := bytes.Repeat([]byte("y"), size)
+		body, n, err := spoolBody(bytes.NewReader(data), -1)
+		if err != nil || n != int64(size) {
+			t.Fatalf("%d bytes: length %d, error %v", size, n, err)
+		}
+		var got bytes.Buffer
+		got.ReadFrom(body)
+		body.Close()
+		if !bytes.Equal(got.Bytes(), data) {
+			t.Errorf("%d bytes: content differs", size)
+		}
+		if sf, ok := body.(*spooledFile); ok {
+			if _, err := os.Stat(sf.Name()); err == nil {
+				t.Errorf("%d bytes: spool file not removed", size)
+			}
+		}
+	}
+
+	if _, _, err := spoolBody(bytes.NewReader(make([]byte, spoolMemory+10)), spoolMemory+9); err != ErrBodyTooLarge {
+		t.Errorf("error %v, want ErrBodyTooLarge", err)
+	}
+}
+
+// A request stream filter that doubles every byte of the body, changing its
+// length
+var doubleBody RequestStreamFilter = func(conn *Conn, req *http.Request, reader io.ReadCloser, writer io.WriteCloser) bool {
+	conn.Go(func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := reader.Read(buf)
+			for _, b := range buf[:n] {
+				writer.Write([]byte{b, b})
+			}
+			if err != nil {
+				break
+			}
+		}
+		writer.Close()
+	})
+	return true
+}
+
+func TestRequestStreamFilterCGI(t *testing.T) {
+	chain := Chain(doubleBody, doubleBody, CGIServer(echoScript(t), "/"), OutputPipe)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("abc"))
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if want := "length=12\naaaabbbbcccc"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("status %d, body %q, want %q", rec.Code, rec.Body, want)
+	}
+}
+
+func TestSpoolRequestLimit(t *testing.T) {
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	chain := Chain(NewCGIServer(echoScript(t), "/", CGIOptions{MaxSpooledBody: spoolMemory + 10}), OutputPipe)
+
+	for _, size := range []int{10, spoolMemory + 10, spoolMemory + 11} {
+		content := strings.Repeat("x", size)
+		req := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(content)))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		chain.ServeHTTP(rec, req)
+
+		want := "length=" + strconv.Itoa(size) + "\n" + content
+		if size > spoolMemory+10 {
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("%d bytes: status %d, want 413", size, rec.Code)
+			}
+		} else if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%d bytes: status %d, body %.40q", size, rec.Code, rec.Body)
+		}
+	}
+	checkSpoolRemoved(t, spool)
+}
+
+func TestRequestStreamFilterHandler(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "length=%d header=%q\n%s", req.ContentLength, req.Header.Get("Content-Length"), body)
+	})
+	chain := Chain(doubleBody, NewHandlerComponent(echo), OutputPipe)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("abc"))
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if want := "length=-1 header=\"\"\naabbcc"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("status %d, body %q, want %q", rec.Code, rec.Body, want)
+	}
+}
+
+func TestRequestStreamFilterBodyLimit(t *testing.T) {
+	chain := Chain(doubleBody, MaxBodySize(5, nil), CGIServer(echoScript(t), "/"), OutputPipe)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("abc"))
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", rec.Code)
+	}
+}
+
+// Read the request body, answering with how much was read
+var readBody = ConnFunc(func(conn *Conn, req *http.Request) error {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	return TextStringSource(fmt.Sprintf("read %d", len(data))).HandleConn(conn, req)
+})
+
+// A request with a body of 'size' bytes, of unknown length if 'chunked'
+func bodyRequest(size int, chunked bool) *http.Request {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", size)))
+	if chunked {
+		req.ContentLength = -1
+	}
+	return req
+}
+
+func checkBodyLimit(t *testing.T, handler http.Handler, limit int) {
+	t.Helper()
+	for _, chunked := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, bodyRequest(limit, chunked))
+		if want := fmt.Sprint("read ", limit); rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("%d bytes (chunked %v): status %d, body %q", limit, chunked, rec.Code, rec.Body)
+		}
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, bodyRequest(limit+1, chunked))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%d bytes (chunked %v): status %d, want 413", limit+1, chunked, rec.Code)
+		}
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	checkBodyLimit(t, Chain(MaxBodySize(10, nil), readBody, OutputPipe), 10)
+}
+
+func TestMaxBodySizeNetwork(t *testing.T) {
+	handler := NetworkHandler(MaxBodySize(10, nil), readBody, OutputPipe)
+	checkBodyLimit(t, handler, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %s", err)
+	}
+}
+
+// Authenticate each request as the user named in the X-User header
+var headerUser Pipe = func(conn *Conn, req *http.Request) bool {
+	conn.user = req.Header.Get("X-User")
+	return true
+}
+
+func TestUploadQuota(t *testing.T) {
+	quota := NewUploadQuota(20)
+	chain := Chain(headerUser, quota.Pipe(nil), readBody, OutputPipe)
+	send := func(user string, size int, chunked bool) int {
+		req := bodyRequest(size, chunked)
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		chain.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Known lengths are checked against what is left up front
+	if code := send("alice", 10, false); code != http.StatusOK {
+		t.Errorf("first upload: status %d", code)
+	}
+	if code := send("alice", 11, false); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over quota: status %d, want 413", code)
+	}
+	if used := quota.Used("alice"); used != 10 {
+		t.Errorf("used %d after refused upload, want 10", used)
+	}
+	if code := send("alice", 10, false); code != http.StatusOK {
+		t.Errorf("upload to exactly the quota: status %d", code)
+	}
+
+	// Chunked bodies fail once they go over
+	if code := send("bob", 15, true); code != http.StatusOK {
+		t.Errorf("chunked upload: status %d", code)
+	}
+	if code := send("bob", 6, true); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked upload over quota: status %d, want 413", code)
+	}
+
+	// Requests that aren't authenticated aren't counted
+	if code := send("", 100, false); code != http.StatusOK {
+		t.Errorf("anonymous upload: status %d", code)
+	}
+}
+
+func TestUploadQuotaNetwork(t *testing.T) {
+	quota := NewUploadQuota(5)
+	handler := NetworkHandler(headerUser, quota.Pipe(nil), readBody, OutputPipe)
+
+	req := bodyRequest(10, false)
+	req.Header.Set("X-User", "alice")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", rec.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %s", err)
+	}
+}
@@ -0,0 +1,115 @@
+package webpipes
+
+import "net"
+import "net/http"
+import "strings"
+import "sync"
+
+//////////////////////////////////////////////////////////////////////////////
+// Content-based routing for process networks
+//
+// A process network is a straight line of components, so serving different
+// content for different paths would otherwise need a separate network (and a
+// separate NetworkHandler) for each. A Router inspects each connection and
+// sends it down the first matching route, which is usually the In channel of
+// another network, while connections that match no route carry on through
+// the network the Router is part of. Merge joins the Out channels of the
+// branches back together so they can share the rest of a network.
+
+// A Predicate decides whether a connection should take a particular route
+type Predicate func(*Conn, *http.Request) bool
+
+// Match requests for 'prefix' or anything below it
+func PathPrefix(prefix string) Predicate {
+	return func(conn *Conn, req *http.Request) bool {
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}
+}
+
+// Match requests made with any of the given methods
+func Method(methods ...string) Predicate {
+	return func(conn *Conn, req *http.Request) bool {
+		for _, method := range methods {
+			if req.Method == method {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Match requests for the given host, ignoring case and any port
+func Host(host string) Predicate {
+	return func(conn *Conn, req *http.Request) bool {
+		reqHost := req.Host
+		if h, _, err := net.SplitHostPort(reqHost); err == nil {
+			reqHost = h
+		}
+		return strings.EqualFold(reqHost, host)
+	}
+}
+
+// Match requests where the header 'key' has the value 'value'
+func HeaderIs(key, value string) Predicate {
+	return func(conn *Conn, req *http.Request) bool {
+		return req.Header.Get(key) == value
+	}
+}
+
+// Match responses whose Content-Type has any of the given prefixes, such as
+// "text/" or "application/json". This only makes sense once a source has
+// run.
+func ContentType(prefixes ...string) Predicate {
+	return func(conn *Conn, req *http.Request) bool {
+		contentType := strings.ToLower(conn.GetHeader("Content-Type"))
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(contentType, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// A destination for connections that match a predicate
+type Route struct {
+	Match Predicate
+	To    chan<- *Conn
+}
+
+// Send each connection down the first route that it matches. Connections that
+// match no route are passed on to the next component.
+func Router(routes ...Route) Pipe {
+	return func(conn *Conn, req *http.Request) bool {
+		for _, route := range routes {
+			if route.Match(conn, req) {
+				route.To <- conn
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Join several channels into one. The returned channel is closed once all of
+// the input channels have been closed.
+func Merge(ins ...chan *Conn) chan *Conn {
+	out := make(chan *Conn)
+
+	var wg sync.WaitGroup
+	for _, in := range ins {
+		wg.Add(1)
+		go func(in chan *Conn) {
+			for conn := range in {
+				out <- conn
+			}
+			wg.Done()
+		}(in)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
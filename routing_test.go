@@ -0,0 +1,83 @@
+package webpipes
+
+import "context"
+import "net/http"
+import "net/http/httptest"
+import "sync"
+import "testing"
+import "time"
+
+func TestRouterMerge(t *testing.T) {
+	a := ProcNetwork(TextStringSource("branch a"))
+	b := ProcNetwork(TextStringSource("branch b"))
+	site := ProcNetwork(
+		Router(
+			Route{Match: PathPrefix("/a/"), To: a.In},
+			Route{Match: PathPrefix("/b/"), To: b.In},
+		),
+		TextStringSource("default"),
+	)
+	output := ProcNetworkInOut(Merge(site.Out, a.Out, b.Out), nil, OutputPipe)
+	handler := NetworkHandlerInOut(site.In, output.Out, site, a, b, output)
+
+	want := map[string]string{"/a/x": "branch a", "/b/y": "branch b", "/c": "default"}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for path, body := range want {
+			wg.Add(1)
+			go func(path, body string) {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+				if rec.Code != http.StatusOK || rec.Body.String() != body {
+					t.Errorf("%s: status %d, body %q, want %q", path, rec.Code, rec.Body, body)
+				}
+			}(path, body)
+		}
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %s", err)
+	}
+	if _, ok := <-output.Out; ok {
+		t.Errorf("output network still running after shutdown")
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/a/x", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("after shutdown: status %d, want 503", rec.Code)
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://Example.com:8080/api/items", nil)
+	req.Header.Set("X-Mode", "test")
+	conn := NewConn(httptest.NewRecorder(), req)
+	conn.SetHeader("Content-Type", "Application/JSON; charset=utf-8")
+
+	tests := []struct {
+		name  string
+		match Predicate
+		want  bool
+	}{
+		{"prefix", PathPrefix("/api/"), true},
+		{"other prefix", PathPrefix("/static/"), false},
+		{"method", Method("GET", "POST"), true},
+		{"other method", Method("GET"), false},
+		{"host", Host("example.com"), true},
+		{"other host", Host("example.org"), false},
+		{"header", HeaderIs("X-Mode", "test"), true},
+		{"other header", HeaderIs("X-Mode", "live"), false},
+		{"content type", ContentType("text/", "application/json"), true},
+		{"other content type", ContentType("image/"), false},
+	}
+	for _, test := range tests {
+		if got := test.match(conn, req); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package webpipes
+
+import "bufio"
+import "context"
+import "encoding/binary"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "strconv"
+import "strings"
+import "sync"
+
+//////////////////////////////////////////////////////////////////////////////
+// SCGI and uwsgi
+//
+// Both protocols send the CGI variables for a request as a single block at
+// the start of a connection, followed by the request body, and read back a
+// CGI response until the application closes the connection. Since a
+// connection only ever carries one request there is nothing to keep open
+// between requests, so rather than a pool of idle connections the number
+// open at once is limited by MaxConns, and MaxIdle is ignored. The length of
+// the body has to be sent up front, so a chunked body is read in full first,
+// up to MaxSpooledBody.
+
+// Pass requests to the SCGI application at 'addr' on 'network' ("tcp" or
+// "unix"). The application is mounted at 'prefix', which is given to it as
+// SCRIPT_NAME, with the rest of the path as PATH_INFO.
+func SCGIServer(network, addr, prefix string) Source {
+	return NewSCGIServer(network, addr, prefix, GatewayOptions{})
+}
+
+// As SCGIServer, configured with 'opts'
+func NewSCGIServer(network, addr, prefix string, opts GatewayOptions) Source {
+	return streamGateway(network, addr, prefix, opts, encodeSCGIHeader)
+}
+
+// Pass requests to the uwsgi application at 'addr' on 'network' ("tcp" or
+// "unix"), mounted at 'prefix' as for SCGIServer
+func UWSGIServer(network, addr, prefix string) Source {
+	return NewUWSGIServer(network, addr, prefix, GatewayOptions{})
+}
+
+// As UWSGIServer, configured with 'opts'
+func NewUWSGIServer(network, addr, prefix string, opts GatewayOptions) Source {
+	return streamGateway(network, addr, prefix, opts, encodeUWSGIHeader)
+}
+
+// Create a source for a protocol that sends the variables encoded by
+// 'encode' and then the body of the request over a new connection
+func streamGateway(network, addr, prefix string, opts GatewayOptions, encode func(cgiEnv) ([]byte, error)) Source {
+	opts.defaults()
+	var slots chan struct{}
+	if opts.MaxConns > 0 {
+		slots = make(chan struct{}, opts.MaxConns)
+	}
+	dialer := net.Dialer{Timeout: opts.DialTimeout}
+
+	return func(conn *Conn, req *http.Request, writer io.WriteCloser) bool {
+		if err := spoolRequest(conn, req, opts.MaxSpooledBody); err != nil {
+			writer.Close()
+			log.Printf("webpipes: cannot read request body for %s: %s", req.URL, err)
+			conn.HTTPStatusResponse(errorStatus(err))
+			return true
+		}
+
+		env := newCGIEnv(conn, req, prefix, strings.TrimPrefix(req.URL.Path, prefix), "")
+		env.set("CONTENT_LENGTH", strconv.FormatInt(req.ContentLength, 10))
+		env.setAll(opts.Env)
+		header, err := encode(env)
+		if err != nil {
+			writer.Close()
+			proxyError(conn, req, err)
+			return true
+		}
+
+		resp, err := gatewayHeader(conn, opts.Timeout, func(ctx context.Context) (*gatewayResponse, error) {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return nil, context.Cause(ctx)
+				}
+			}
+			nc, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				if slots != nil {
+					<-slots
+				}
+				return nil, err
+			}
+
+			var once sync.Once
+			done := func() {
+				once.Do(func() {
+					nc.Close()
+					if slots != nil {
+						<-slots
+					}
+				})
+			}
+			if _, err := nc.Write(header); err != nil {
+				done()
+				return nil, err
+			}
+			if req.ContentLength > 0 {
+				conn.Go(func() {
+					if _, err := io.Copy(nc, io.LimitReader(req.Body, req.ContentLength)); err != nil {
+						done()
+					}
+				})
+			}
+			return &gatewayResponse{bufio.NewReader(nc), done}, nil
+		})
+		if err != nil {
+			writer.Close()
+			proxyError(conn, req, err)
+			return true
+		}
+		gatewayBody(conn, resp, writer)
+		return true
+	}
+}
+
+// Encode the variables as an SCGI netstring, which must start with
+// CONTENT_LENGTH and include SCGI=1
+func encodeSCGIHeader(env cgiEnv) ([]byte, error) {
+	var block []byte
+	add := func(name, value string) {
+		block = append(block, name...)
+		block = append(block, 0)
+		block = append(block, value...)
+		block = append(block, 0)
+	}
+	add("CONTENT_LENGTH", env.get("CONTENT_LENGTH"))
+	add("SCGI", "1")
+	for _, v := range env {
+		if v.name != "CONTENT_LENGTH" && v.name != "SCGI" {
+			add(v.name, v.value)
+		}
+	}
+
+	buf := strconv.AppendInt(nil, int64(len(block)), 10)
+	buf = append(buf, ':')
+	buf = append(buf, block...)
+	return append(buf, ','), nil
+}
+
+// Encode the variables as a uwsgi packet, whose header gives the size of the
+// variables that follow as a 16-bit number
+func encodeUWSGIHeader(env cgiEnv) ([]byte, error) {
+	buf := make([]byte, 4)
+	for _, v := range env {
+		if len(v.name) > 0xffff || len(v.value) > 0xffff {
+			return nil, fmt.Errorf("webpipes: uwsgi variable %s too long", v.name)
+		}
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(v.name)))
+		buf = append(buf, v.name...)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(v.value)))
+		buf = append(buf, v.value...)
+	}
+
+	size := len(buf) - 4
+	if size > 0xffff {
+		return nil, fmt.Errorf("webpipes: uwsgi request variables too large (%d bytes)", size)
+	}
+	// modifier1 and modifier2 are zero for a WSGI request
+	binary.LittleEndian.PutUint16(buf[1:], uint16(size))
+	return buf, nil
+}
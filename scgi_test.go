@@ -0,0 +1,245 @@
+package webpipes
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "io"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// Start a server handling each connection with 'handle', returning its
+// address
+func testGatewayServer(t *testing.T, handle func(nc net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				handle(nc)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// Read the SCGI variables at the start of a request
+func readSCGIHeader(br *bufio.Reader) map[string]string {
+	size, _ := br.ReadString(':')
+	n, _ := strconv.Atoi(strings.TrimSuffix(size, ":"))
+	block := make([]byte, n+1)
+	io.ReadFull(br, block)
+
+	fields := bytes.Split(block[:n], []byte{0})
+	env := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		env[string(fields[i])] = string(fields[i+1])
+	}
+	return env
+}
+
+// Read the uwsgi variables at the start of a request
+func readUWSGIHeader(br *bufio.Reader) (map[string]string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 || header[3] != 0 {
+		return nil, fmt.Errorf("modifiers %d and %d", header[0], header[3])
+	}
+	block := make([]byte, binary.LittleEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(br, block); err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string)
+	field := func() (string, error) {
+		if len(block) < 2 {
+			return "", io.ErrUnexpectedEOF
+		}
+		n := int(binary.LittleEndian.Uint16(block))
+		if len(block) < 2+n {
+			return "", io.ErrUnexpectedEOF
+		}
+		value := string(block[2 : 2+n])
+		block = block[2+n:]
+		return value, nil
+	}
+	for len(block) > 0 {
+		name, err := field()
+		if err != nil {
+			return nil, err
+		}
+		if env[name], err = field(); err != nil {
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+// Answer a request with the length it was given and its body
+func echoGatewayBody(nc net.Conn, br *bufio.Reader, env map[string]string) {
+	length, _ := strconv.Atoi(env["CONTENT_LENGTH"])
+	body := make([]byte, length)
+	io.ReadFull(br, body)
+	fmt.Fprintf(nc, "Content-Type: text/plain\r\n\r\nlength=%s\n%s", env["CONTENT_LENGTH"], body)
+}
+
+// Start an SCGI server that reports the length it was given and echoes the
+// body, returning its address
+func testSCGI(t *testing.T) string {
+	return testGatewayServer(t, func(nc net.Conn) {
+		br := bufio.NewReader(nc)
+		echoGatewayBody(nc, br, readSCGIHeader(br))
+	})
+}
+
+func TestSCGIChunkedBody(t *testing.T) {
+	chain := Chain(SCGIServer("tcp", testSCGI(t), ""), OutputPipe)
+
+	req := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body")))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if want := "length=12\nchunked body"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("status %d, body %q, want %q", rec.Code, rec.Body, want)
+	}
+}
+
+func TestUWSGIServer(t *testing.T) {
+	addr := testGatewayServer(t, func(nc net.Conn) {
+		br := bufio.NewReader(nc)
+		env, err := readUWSGIHeader(br)
+		if err != nil {
+			t.Errorf("bad uwsgi header: %s", err)
+			return
+		}
+		for _, name := range []string{"REQUEST_METHOD", "SCRIPT_NAME", "PATH_INFO", "QUERY_STRING", "HTTP_X_TEST", "EXTRA"} {
+			fmt.Fprintf(nc, "X-%s: %s\r\n", strings.ReplaceAll(name, "_", "-"), env[name])
+		}
+		echoGatewayBody(nc, br, env)
+	})
+	opts := GatewayOptions{Env: []string{"EXTRA=extra"}}
+	chain := Chain(NewUWSGIServer("tcp", addr, "/app", opts), OutputPipe)
+
+	req := httptest.NewRequest("POST", "/app/path?q=1", strings.NewReader("request body"))
+	req.Header.Set("X-Test", "header")
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, req)
+	if want := "length=12\nrequest body"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("status %d, body %q, want %q", rec.Code, rec.Body, want)
+	}
+	want := map[string]string{
+		"X-Request-Method": "POST",
+		"X-Script-Name":    "/app",
+		"X-Path-Info":      "/path",
+		"X-Query-String":   "q=1",
+		"X-Http-X-Test":    "header",
+		"X-Extra":          "extra",
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("%s: %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestEncodeUWSGIHeader(t *testing.T) {
+	var env cgiEnv
+	env.set("EMPTY", "")
+	env.set("LONG", strings.Repeat("x", 1000))
+	env.set("UNICODE", "\u00e9t\u00e9")
+	data, err := encodeUWSGIHeader(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readUWSGIHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(env) {
+		t.Errorf("%d variables decoded, want %d", len(got), len(env))
+	}
+	for _, v := range env {
+		if got[v.name] != v.value {
+			t.Errorf("%s: %.20q, want %.20q", v.name, got[v.name], v.value)
+		}
+	}
+
+	// Neither a variable nor the whole block may be longer than 64KB
+	env = nil
+	env.set("TOO_LONG", strings.Repeat("x", 0x10000))
+	if _, err := encodeUWSGIHeader(env); err == nil {
+		t.Errorf("variable too long encoded")
+	}
+	env = nil
+	for i := 0; i < 3; i++ {
+		env.set(fmt.Sprintf("VAR%d", i), strings.Repeat("x", 0x6000))
+	}
+	if _, err := encodeUWSGIHeader(env); err == nil {
+		t.Errorf("variables too large encoded")
+	}
+}
+
+func TestSCGITimeout(t *testing.T) {
+	// The application reads the request but never answers
+	addr := testGatewayServer(t, func(nc net.Conn) {
+		io.Copy(io.Discard, nc)
+	})
+	opts := GatewayOptions{Timeout: 100 * time.Millisecond}
+	chain := Chain(NewSCGIServer("tcp", addr, "", opts), OutputPipe)
+
+	rec := httptest.NewRecorder()
+	chain.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", rec.Code)
+	}
+}
+
+func TestSCGIMaxConns(t *testing.T) {
+	var open, most atomic.Int32
+	addr := testGatewayServer(t, func(nc net.Conn) {
+		n := open.Add(1)
+		defer open.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		br := bufio.NewReader(nc)
+		env := readSCGIHeader(br)
+		time.Sleep(50 * time.Millisecond)
+		echoGatewayBody(nc, br, env)
+	})
+	chain := Chain(NewSCGIServer("tcp", addr, "", GatewayOptions{MaxConns: 2}), OutputPipe)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			chain.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("status %d", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := most.Load(); n > 2 {
+		t.Errorf("%d connections open at once, want at most 2", n)
+	}
+}
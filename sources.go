@@ -1,22 +1,19 @@
 package webpipes
 
 import "net/http"
-import "net/http/cgi"
 import "io"
 
-// Serve files from 'root', stripping 'prefix' from the URL being requested
+// Serve files from 'root', stripping 'prefix' from the URL being requested.
+// Precompressed siblings of the requested files are served to clients that
+// accept them, see NewFileServer.
 func FileServer(root, prefix string) Component {
-	handler := http.StripPrefix(prefix, http.FileServer(http.Dir(root)))
-	return NewHandlerComponent(handler)
+	return NewFileServer(root, prefix, FileServerOptions{})
 }
 
 // Serve a CGI application 'path', stripping 'prefix' from the URL being
-// requested
+// requested. See NewCGIServer for the limits that can be placed on it.
 func CGIServer(path, prefix string) Component {
-	handler := new(cgi.Handler)
-	handler.Path = path
-	handler.Root = prefix
-	return NewHandlerComponent(handler)
+	return NewCGIServer(path, prefix, CGIOptions{})
 }
 
 // Respond with a string as text/plain output
@@ -24,10 +21,10 @@ func TextStringSource(str string) Source {
 	return func(conn *Conn, req *http.Request, writer io.WriteCloser) bool {
 		conn.status = http.StatusOK
 		conn.SetHeader("Content-type", "text/plain; charset=utf-8")
-		go func() {
+		conn.Go(func() {
 			io.WriteString(writer, str)
 			writer.Close()
-		}()
+		})
 
 		return true
 	}
@@ -2,15 +2,15 @@ package webpipes
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"fmt"
+	"sync"
 )
-import "fmt"
 import "net/http"
 import "io"
 import "log"
 
-import "strconv"
-
 // The http package requires that every http.Handler provide a single method:
 //
 // ServeHTTP(http.ResponseWriter, *http.Request)
@@ -31,6 +31,52 @@ type Conn struct {
 	body    io.ReadCloser
 	status  int
 	written int64
+	ctx     context.Context
+	cancel  context.CancelFunc
+	err     error
+	pages   *ErrorPages
+
+	// The user the request was authenticated as, if any
+	user string
+
+	// The number of times the content has been transformed, and the
+	// functions to run before the response is written
+	representation int
+	beforeOutput   []func()
+	trailers       []trailer
+
+	// Set once the request body has been taken by NewRequestReader and
+	// not yet replaced
+	requestTaken bool
+
+	// Closed when the connection leaves a network served by NetworkHandler
+	finished chan struct{}
+
+	// Set once the response has been sent early, when an overloaded
+	// component loop sheds the connection or a component with no bypass
+	// channel writes it out, so that the rest of the network passes it
+	// through untouched
+	delivered bool
+
+	// The component currently handling the connection, used to identify
+	// the source of panics
+	component string
+
+	// State shared with the content goroutines, protected by the mutex
+	mu          sync.Mutex
+	pipes       []pipeEnds
+	wroteHeader bool
+	panicked    error
+}
+
+type trailer struct {
+	key   string
+	value func() string
+}
+
+type pipeEnds struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
 }
 
 // Constructor for a connection object, used internally by this package but
@@ -39,20 +85,155 @@ func NewConn(rwriter http.ResponseWriter, request *http.Request) *Conn {
 	conn := new(Conn)
 	conn.Request = request
 	conn.rwriter = rwriter
+	conn.ctx, conn.cancel = context.WithCancel(request.Context())
+	context.AfterFunc(conn.ctx, func() {
+		conn.abortPipes(context.Cause(conn.ctx))
+	})
 	return conn
 }
 
+// Return the context for this connection. It is derived from the context of
+// the request and is cancelled when the client goes away, when the connection
+// is closed, or when the handler that created the connection has finished.
+// Components that spawn goroutines should use it to abandon their work.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// Return the name of the user that the request has been authenticated as by
+// a component such as SimpleAuth, or the empty string.
+func (c *Conn) User() string {
+	return c.user
+}
+
+// Return the error that caused this connection to be handed to an error
+// handler, or nil if no component has failed.
+func (c *Conn) Err() error {
+	return c.err
+}
+
 // Return a new content writer
+//
+// Both ends of the pipe are closed with the context error as soon as the
+// connection context is cancelled, so any goroutine blocked copying content
+// through the pipeline will return rather than leak.
 func (c *Conn) NewContentWriter() io.WriteCloser {
 	if c.body != nil {
 		// There is a dangling reader that needs to be consumed first
 		return nil
 	}
 	reader, writer := io.Pipe()
+
+	c.mu.Lock()
+	c.pipes = append(c.pipes, pipeEnds{reader, writer})
+	c.mu.Unlock()
+	if err := c.ctx.Err(); err != nil {
+		reader.CloseWithError(err)
+		writer.CloseWithError(err)
+	}
+
 	c.body = reader
 	return writer
 }
 
+// Close every content pipe created so far with 'err', unblocking any
+// goroutine that is reading or writing content for this connection.
+func (c *Conn) abortPipes(err error) {
+	c.mu.Lock()
+	pipes := c.pipes
+	c.pipes = nil
+	c.mu.Unlock()
+
+	for _, pipe := range pipes {
+		pipe.reader.CloseWithError(err)
+		pipe.writer.CloseWithError(err)
+	}
+}
+
+// Called by the output pipes immediately before the status line and headers
+// are written. If a content goroutine has already panicked, the response is
+// replaced with a 500 first.
+func (c *Conn) startResponse() {
+	hooks := c.beforeOutput
+	c.beforeOutput = nil
+	for _, hook := range hooks {
+		hook()
+	}
+
+	c.mu.Lock()
+	panicked := c.panicked
+	c.wroteHeader = true
+	c.mu.Unlock()
+
+	if panicked != nil {
+		c.HTTPStatusResponse(http.StatusInternalServerError)
+	}
+}
+
+// Signal that the connection has left the network it was injected into.
+// Connections that were not injected by a NetworkHandler are ignored.
+func (c *Conn) finish() {
+	if c.finished != nil {
+		close(c.finished)
+	}
+}
+
+// Register 'fn' to be run by the output pipe just before the response is
+// written, once every other component has had its say. This allows a
+// component to make decisions that depend on what later components do, such
+// as whether they transform the content. Functions are run in the order they
+// were registered, and may replace the content.
+func (c *Conn) BeforeOutput(fn func()) {
+	c.beforeOutput = append(c.beforeOutput, fn)
+}
+
+// Register a trailer field 'key' to be sent after the content. Its value is
+// found by calling 'value' once all of the content has been written, so it
+// may depend on the content, and the trailer is left out if it returns the
+// empty string. Trailers are only delivered when the response is chunked, and
+// clients are free to ignore them.
+func (c *Conn) Trailer(key string, value func() string) {
+	c.trailers = append(c.trailers, trailer{key, value})
+}
+
+// Called by the output pipes once the content has been written, to add any
+// trailers to the response
+func (c *Conn) writeTrailers() {
+	for _, t := range c.trailers {
+		if value := t.value(); value != "" {
+			c.rwriter.Header().Set(http.TrailerPrefix+t.key, value)
+		}
+	}
+}
+
+// Record that the bytes of the content are being changed, so that anything
+// derived from them, such as an ETag or a byte range, no longer applies.
+// Filters that transform the content should call this.
+func (c *Conn) ChangeRepresentation() {
+	c.representation++
+}
+
+// Return a value that changes whenever ChangeRepresentation is called, so a
+// component can tell whether a later component has changed the content.
+func (c *Conn) Representation() int {
+	return c.representation
+}
+
+// Close the content reader without reading it, for responses that have no
+// body.
+func (c *Conn) discardContent() {
+	if reader := c.NewContentReader(); reader != nil {
+		reader.Close()
+	}
+}
+
+// Report whether the output pipe has started writing the response
+func (c *Conn) headerWritten() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wroteHeader
+}
+
 // Return a new content reader
 func (c *Conn) NewContentReader() io.ReadCloser {
 	if c.body == nil {
@@ -64,6 +245,57 @@ func (c *Conn) NewContentReader() io.ReadCloser {
 	return reader
 }
 
+// Return a reader for the body of the request, which the caller is then
+// responsible for replacing by way of NewRequestWriter. This mirrors
+// NewContentReader, so that the request body can be passed through a
+// pipeline of filters before a source consumes it.
+func (c *Conn) NewRequestReader() io.ReadCloser {
+	if c.requestTaken {
+		// The body has already been taken and not replaced
+		return nil
+	}
+	body := c.Request.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	c.requestTaken = true
+	return body
+}
+
+// Return a writer for a new request body. Whatever is written to it is what
+// sources and later components will read from the request. The length of the
+// new body is not known, so the Content-Length of the request is removed.
+// Sources that need the length, such as CGIServer, read the whole body first
+// to find it.
+func (c *Conn) NewRequestWriter() io.WriteCloser {
+	if !c.requestTaken {
+		// The existing body needs to be taken first
+		return nil
+	}
+	reader, writer := io.Pipe()
+
+	c.mu.Lock()
+	c.pipes = append(c.pipes, pipeEnds{reader, writer})
+	c.mu.Unlock()
+	if err := c.ctx.Err(); err != nil {
+		reader.CloseWithError(err)
+		writer.CloseWithError(err)
+	}
+
+	c.setRequestBody(c.Request, reader)
+	c.Request.ContentLength = -1
+	c.Request.Header.Del("Content-Length")
+	return writer
+}
+
+// Replace the body of the request, both on the connection and on 'req' if a
+// component has been given a modified copy of the request.
+func (c *Conn) setRequestBody(req *http.Request, body io.ReadCloser) {
+	c.Request.Body = body
+	req.Body = body
+	c.requestTaken = false
+}
+
 // Set a header in the eventual response.
 //
 // Unfortunately due to non-exported methods in the ResponseWriter, we need to
@@ -77,15 +309,34 @@ func (c *Conn) GetHeader(key string) string {
 	return c.rwriter.Header().Get(key)
 }
 
+// Remove a header from the eventual response
+func (c *Conn) DelHeader(key string) {
+	c.rwriter.Header().Del(key)
+}
+
 // Set the numeric static code of the response
 func (c *Conn) SetStatus(status int) {
 	c.status = status
 }
 
-// Provide a canned HTTP status response, including content body
+// Provide a canned HTTP status response, including content body. The body is
+// rendered by the error pages configured for the connection.
 func (c *Conn) HTTPStatusResponse(status int) {
-	c.SetHeader("Content-Type", "text/plain; charset=utf-8")
+	pages := c.pages
+	if pages == nil {
+		pages = DefaultErrorPages
+	}
+	contentType, content := pages.render(c.Request, status)
+
+	// Whatever was going to be sent is being replaced, so headers describing
+	// it no longer apply
+	c.DelHeader("Content-Length")
+	c.DelHeader("Content-Encoding")
+	c.DelHeader("Content-Range")
+
+	c.SetHeader("Content-Type", contentType)
 	c.SetStatus(status)
+	c.ChangeRepresentation()
 
 	writer := c.NewContentWriter()
 	if writer == nil {
@@ -98,23 +349,17 @@ func (c *Conn) HTTPStatusResponse(status int) {
 		writer = c.NewContentWriter()
 	}
 
-	statusText := http.StatusText(status)
-	if statusText == "" {
-		statusText = "status code " + strconv.Itoa(status)
-	}
-
-	content := fmt.Sprintf("%s\n", statusText)
-
-	go func(writer io.WriteCloser, content string) {
-		io.WriteString(writer, content)
+	c.Go(func() {
+		writer.Write(content)
 		writer.Close()
-	}(writer, content)
+	})
 }
 
 // This function will forcibly close the underlying network connection and shut
 // down the connection object. Once this has been called, the connection and
 // the network should not be used at all
 func (c *Conn) Close() {
+	c.cancel()
 	rwc, _, _ := c.Hijack()
 	if rwc != nil {
 		rwc.Close()
@@ -147,32 +392,145 @@ type Source func(*Conn, *http.Request, io.WriteCloser) bool
 type Filter func(*Conn, *http.Request, io.ReadCloser, io.WriteCloser) bool
 type Pipe func(*Conn, *http.Request) bool
 
+// The bool returned by HandleHTTPRequest can only say 'carry on' or 'I have
+// taken the connection', so a component that fails has to produce its own
+// error response and pretend all is well. A ConnHandler returns an error
+// instead, which gives three outcomes:
+//
+//   nil         the connection should be passed to the next component
+//   ErrHandled  the component has dealt with the connection (for example by
+//               sending it down a bypass channel) and nothing else should
+//               touch it
+//   other       the component failed, and the error should be handed to
+//               whatever error handling the chain or network has configured
+//
+// Sources, filters and pipes implement both interfaces, and any Component
+// can be used where a ConnHandler is needed by way of HandlerFor.
+
+type ConnHandler interface {
+	HandleConn(*Conn, *http.Request) error
+}
+
+// Returned by a ConnHandler that has taken responsibility for the connection
+var ErrHandled = errors.New("webpipes: connection handled")
+
+// Returned when a component asks for a content reader or writer that the
+// pipeline cannot provide, which indicates a badly constructed pipeline.
+var ErrNoContentReader = errors.New("webpipes: no content reader available")
+var ErrNoContentWriter = errors.New("webpipes: no content writer available")
+
+// An error that should be reported to the client with a particular status
+// code, rather than as a 500
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Err)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// Return the status code that should be sent for 'err'
+func errorStatus(err error) int {
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		return serr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// A function that implements both Component and ConnHandler
+type ConnFunc func(*Conn, *http.Request) error
+
+func (fn ConnFunc) HandleConn(c *Conn, req *http.Request) error {
+	return fn(c, req)
+}
+
+func (fn ConnFunc) HandleHTTPRequest(c *Conn, req *http.Request) bool {
+	return handleResult(c, fn(c, req))
+}
+
+// Return a ConnHandler for the given component. Components that do not
+// implement ConnHandler have their bool result translated, with false being
+// taken to mean ErrHandled.
+func HandlerFor(comp Component) ConnHandler {
+	if handler, ok := comp.(ConnHandler); ok {
+		return handler
+	}
+	return ConnFunc(func(c *Conn, req *http.Request) error {
+		if !comp.HandleHTTPRequest(c, req) {
+			return ErrHandled
+		}
+		return nil
+	})
+}
+
+// Translate the result of HandleConn into the bool expected by
+// HandleHTTPRequest. A failure has nowhere else to go, so it is logged and
+// turned into a 500 response that continues down the pipeline.
+func handleResult(c *Conn, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case ErrHandled:
+		return false
+	}
+	if _, ok := err.(*PanicError); !ok {
+		// Panics have already been logged along with their stack
+		log.Printf("webpipes: %s %s: %s", c.Request.Method, c.Request.URL, err)
+	}
+	if !c.headerWritten() {
+		c.HTTPStatusResponse(errorStatus(err))
+	}
+	return true
+}
+
 // Utility methods on sources, filters and pipes
 
-func (fn Source) HandleHTTPRequest(c *Conn, req *http.Request) bool {
+func (fn Source) HandleConn(c *Conn, req *http.Request) error {
 	// Allocate a content writer for this source
 	writer := c.NewContentWriter()
 	if writer == nil {
-		// TODO: Output to error log here with relevant information
-		c.HTTPStatusResponse(http.StatusInternalServerError)
-		return true
+		return ErrNoContentWriter
+	}
+
+	if !fn(c, req, writer) {
+		return ErrHandled
 	}
+	return nil
+}
 
-	return fn(c, req, writer)
+func (fn Source) HandleHTTPRequest(c *Conn, req *http.Request) bool {
+	return handleResult(c, fn.HandleConn(c, req))
 }
 
-func (fn Filter) HandleHTTPRequest(c *Conn, req *http.Request) bool {
+func (fn Filter) HandleConn(c *Conn, req *http.Request) error {
 	// Allocate new content reader/writer for the filter
 	reader := c.NewContentReader()
+	if reader == nil {
+		return ErrNoContentReader
+	}
 	writer := c.NewContentWriter()
 
-	if reader == nil || writer == nil {
-		// TODO: Output to error log here with relevant information
-		c.HTTPStatusResponse(http.StatusInternalServerError)
-		return true
+	if !fn(c, req, reader, writer) {
+		return ErrHandled
 	}
+	return nil
+}
 
-	return fn(c, req, reader, writer)
+func (fn Filter) HandleHTTPRequest(c *Conn, req *http.Request) bool {
+	return handleResult(c, fn.HandleConn(c, req))
+}
+
+func (fn Pipe) HandleConn(c *Conn, req *http.Request) error {
+	if !fn(c, req) {
+		return ErrHandled
+	}
+	return nil
 }
 
 func (fn Pipe) HandleHTTPRequest(c *Conn, req *http.Request) bool {
@@ -284,11 +642,24 @@ func (hc *HandlerComponent) HandleHTTPRequest(c *Conn, req *http.Request) bool {
 	adapter := &HandlerRWAdapter{
 		rwriter: c.rwriter,
 		cwriter: writer,
-		done:    make(chan bool),
+		done:    make(chan bool, 1),
 		conn:    c,
 	}
 
+	// The handler clears adapter.done once it has signalled, so wait on a
+	// copy of the channel
+	done := adapter.done
+	component := c.component
 	go func() {
+		// If the handler panics before it has written anything, we still need
+		// to release the component below once the panic has been recorded.
+		defer func() {
+			if adapter.done != nil {
+				adapter.done <- true
+			}
+		}()
+		defer c.recoverContent(component)
+
 		// Run the handler
 		hc.handler.ServeHTTP(adapter, req)
 		// Writing is done, so close the cwriter
@@ -298,7 +669,12 @@ func (hc *HandlerComponent) HandleHTTPRequest(c *Conn, req *http.Request) bool {
 	// We need to wait for a Write or a WriteHeader on the adapter (which is
 	// being used as the response writer for the handler invocation). Since
 	// the handler is still running in a separate goroutine (the one above),
-	// semantically the content generation is still working properly.
-	<-adapter.done
+	// semantically the content generation is still working properly. If the
+	// client goes away first, the content pipe has been closed and the
+	// handler will give up on its next write.
+	select {
+	case <-done:
+	case <-c.Context().Done():
+	}
 	return true
 }
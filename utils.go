@@ -1,6 +1,11 @@
 package webpipes
 
+import "context"
+import "errors"
+import "log"
 import "net/http"
+import "sync"
+import "time"
 
 //////////////////////////////////////////////////////////////////////////////
 // Erlang-style component chains, where each connection is executed in a
@@ -8,21 +13,97 @@ import "net/http"
 
 type _ErlangChain struct {
 	components []Component
+	onError    Component
+	pages      *ErrorPages
 }
 
 func (ch *_ErlangChain) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	conn := NewConn(w, req)
+	conn.pages = ch.pages
+	defer conn.cancel()
 
+	err := ch.run(conn, req)
+	if err != nil && err != ErrHandled {
+		conn.err = err
+		if err := callComponent(ch.errorHandler(), conn, req); err != nil && err != ErrHandled {
+			log.Printf("webpipes: error handler failed: %s", err)
+		}
+	}
+}
+
+// A chain is also a component, so chains can be nested inside one another.
+// An error in a nested chain goes to its own error handler if it has one, and
+// otherwise to the chain it is part of.
+func (ch *_ErlangChain) HandleConn(conn *Conn, req *http.Request) error {
+	err := ch.run(conn, req)
+	if err != nil && err != ErrHandled && ch.onError != nil {
+		conn.err = err
+		if err := callComponent(ch.onError, conn, req); err != nil && err != ErrHandled {
+			return err
+		}
+		return ErrHandled
+	}
+	return err
+}
+
+func (ch *_ErlangChain) HandleHTTPRequest(conn *Conn, req *http.Request) bool {
+	return handleResult(conn, ch.HandleConn(conn, req))
+}
+
+// Run each component in turn, stopping at the first that does not pass the
+// connection on.
+func (ch *_ErlangChain) run(conn *Conn, req *http.Request) error {
 	for _, component := range ch.components {
-		pass := component.HandleHTTPRequest(conn, req)
-		if !pass {
-			panic("this should never happen")
+		if conn.Context().Err() != nil {
+			// The client has gone away, so there is nobody to respond to
+			return ErrHandled
+		}
+		if err := callComponent(component, conn, req); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func Chain(components ...Component) *_ErlangChain {
-	return &_ErlangChain{components}
+	return &_ErlangChain{components: components}
+}
+
+// Route connections for which a component returns an error to 'handler',
+// which is responsible for producing the response. The error is available
+// from Conn.Err. If no handler is set, DefaultErrorHandler is used.
+func (ch *_ErlangChain) OnError(handler Component) *_ErlangChain {
+	ch.onError = handler
+	return ch
+}
+
+// Render canned status responses for this chain using 'pages'
+func (ch *_ErlangChain) WithErrorPages(pages *ErrorPages) *_ErlangChain {
+	ch.pages = pages
+	return ch
+}
+
+func (ch *_ErlangChain) errorHandler() Component {
+	if ch.onError != nil {
+		return ch.onError
+	}
+	return DefaultErrorHandler
+}
+
+// Log the error on the connection and respond with a 500, or the status of a
+// StatusError, writing the response directly since the rest of the chain will
+// not be run. If the response has already been started there is nothing more
+// that can be done.
+var DefaultErrorHandler Pipe = func(conn *Conn, req *http.Request) bool {
+	if _, ok := conn.Err().(*PanicError); !ok {
+		// Panics have already been logged along with their stack
+		log.Printf("webpipes: %s %s: %s", req.Method, req.URL, conn.Err())
+	}
+	if conn.headerWritten() {
+		return false
+	}
+	conn.HTTPStatusResponse(errorStatus(conn.Err()))
+	return OutputPipe(conn, req)
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -32,13 +113,34 @@ func Chain(components ...Component) *_ErlangChain {
 // component has a new goroutine for each incoming request and utilized server
 // farms.
 
-func ProcNetwork(components ...Component) (chan *Conn, chan *Conn) {
+// A running network of component loops. Connections are injected on In and
+// emerge on Out once every component has handled them.
+type Network struct {
+	In  chan *Conn
+	Out chan *Conn
+
+	mu       sync.Mutex
+	closing  bool           // set once Shutdown has been called
+	inflight sync.WaitGroup // connections tracked by enter and exit
+	quit     chan struct{}  // closed to stop the component loops
+	loops    sync.WaitGroup // the running component loops
+	owned    []chan *Conn   // channels created by, and closed with, the network
+	linked   []*Network     // networks shut down along with this one
+	stop     sync.Once
+}
+
+// Returned when a connection is offered to a network that is shutting down
+var ErrNetworkClosed = errors.New("webpipes: network is shutting down")
+
+func ProcNetwork(components ...Component) *Network {
 	return ProcNetworkInOut(nil, nil, components...)
 }
 
-func ProcNetworkInOut(in, out chan *Conn, components ...Component) (chan *Conn, chan *Conn) {
+func ProcNetworkInOut(in, out chan *Conn, components ...Component) *Network {
+	n := &Network{quit: make(chan struct{})}
+
 	if in == nil {
-		in = make(chan *Conn)
+		in = n.makeChan()
 	}
 
 	var prev chan *Conn = in
@@ -50,37 +152,282 @@ func ProcNetworkInOut(in, out chan *Conn, components ...Component) (chan *Conn,
 		if idx == len(components)-1 && out != nil {
 			next = out
 		} else {
-			next = make(chan *Conn)
+			next = n.makeChan()
 		}
 
 		// Spawn a server farm process for this component.
-		go componentLoop(comp, prev, next)
+		n.loops.Add(1)
+		go func(comp Component, in, out chan *Conn) {
+			componentLoop(comp, in, out, n.quit, loopOptions(comp))
+			n.loops.Done()
+		}(comp, prev, next)
 
 		prev = next
 	}
 
-	return in, next
+	n.In, n.Out = in, next
+	return n
+}
+
+func (n *Network) makeChan() chan *Conn {
+	ch := make(chan *Conn)
+	n.owned = append(n.owned, ch)
+	return ch
+}
+
+// Inject 'conn' into the network. Connections sent this way are tracked, so
+// Shutdown will wait for them; the caller must call Done once the connection
+// has come out of the network. Connections sent directly on In are not
+// tracked.
+func (n *Network) Send(conn *Conn) error {
+	if !n.enter() {
+		return ErrNetworkClosed
+	}
+	n.In <- conn
+	return nil
+}
+
+// Mark a connection injected with Send as having left the network
+func (n *Network) Done() {
+	n.inflight.Done()
+}
+
+func (n *Network) enter() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closing {
+		return false
+	}
+	n.inflight.Add(1)
+	return true
+}
+
+// Gracefully shut down the network. New connections are refused, and once
+// every tracked connection has left the network the component loops are
+// stopped and the channels the network created are closed, followed by any
+// networks given to NetworkHandlerInOut. If 'ctx' expires first its error is
+// returned and the network is left running, so that the connections still
+// inside it can finish.
+func (n *Network) Shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	n.closing = true
+	n.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		n.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	n.stop.Do(func() {
+		close(n.quit)
+		n.loops.Wait()
+		for _, ch := range n.owned {
+			close(ch)
+		}
+	})
+	for _, linked := range n.linked {
+		if err := linked.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shut down 'srv' and then the network, both bounded by 'ctx'. The server
+// stops accepting requests and waits for those it is handling first, so
+// nothing is refused by the network while the server is still taking
+// requests. This takes the place of calling srv.Shutdown, and returns the
+// first error either gives.
+func (n *Network) ShutdownServer(ctx context.Context, srv *http.Server) error {
+	err := srv.Shutdown(ctx)
+	if nerr := n.Shutdown(ctx); err == nil {
+		err = nerr
+	}
+	return err
 }
 
 // There will be exactly one of these running for every component in each
 // process chain. This allows them to be re-used as handlers for multiple paths
-// without contention.
-func componentLoop(component Component, in, out chan *Conn) {
-	for conn := range in {
-		go componentHandle(component, conn, out)
+// without contention. The loop runs until 'in' is closed or 'quit' is, and
+// does not return until every connection it has started handling is done.
+func componentLoop(component Component, in, out chan *Conn, quit <-chan struct{}, opts LoopOptions) {
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+
+	// Without a fixed number of workers, each connection gets a goroutine
+	dispatch := func(conn *Conn) {
+		handlers.Add(1)
+		go func() {
+			componentHandle(component, conn, out)
+			handlers.Done()
+		}()
+	}
+
+	if opts.Workers > 0 {
+		// A connection takes a slot while it is queued or being handled, so
+		// the queue never holds more than Buffer connections once every
+		// worker is busy, and sends to it never block
+		slots := make(chan struct{}, opts.Workers+opts.Buffer)
+		work := make(chan *Conn, opts.Workers+opts.Buffer)
+		defer close(work)
+
+		for i := 0; i < opts.Workers; i++ {
+			handlers.Add(1)
+			go func() {
+				for conn := range work {
+					componentHandle(component, conn, out)
+					<-slots
+				}
+				handlers.Done()
+			}()
+		}
+
+		// Answer the client straight away, and send the connection on
+		// through the rest of the network without handling it
+		shed := func(conn *Conn) {
+			handlers.Add(1)
+			go func() {
+				conn.HTTPStatusResponse(http.StatusServiceUnavailable)
+				if err := callComponent(OutputPipe, conn, conn.Request); err != nil && err != ErrHandled {
+					log.Printf("webpipes: cannot send 503 for shed connection: %s", err)
+				}
+				conn.delivered = true
+				out <- conn
+				handlers.Done()
+			}()
+		}
+
+		dispatch = func(conn *Conn) {
+			select {
+			case slots <- struct{}{}:
+				work <- conn
+				return
+			default:
+			}
+
+			switch opts.Overload {
+			case OverloadBlock:
+				slots <- struct{}{}
+				work <- conn
+			case OverloadShed:
+				shed(conn)
+			case OverloadQueue:
+				timer := time.NewTimer(opts.QueueTimeout)
+				defer timer.Stop()
+				select {
+				case slots <- struct{}{}:
+					work <- conn
+				case <-timer.C:
+					shed(conn)
+				}
+			}
+		}
+	}
+
+	for {
+		select {
+		case conn, ok := <-in:
+			if !ok {
+				return
+			}
+			dispatch(conn)
+		case <-quit:
+			return
+		}
 	}
 }
 
 func componentHandle(component Component, conn *Conn, out chan *Conn) {
-	pass := component.HandleHTTPRequest(conn, conn.Request)
-
-	if !pass {
+	if conn.delivered {
+		out <- conn
 		return
 	}
+	err := callComponent(component, conn, conn.Request)
+
+	if err == ErrHandled {
+		// A connection that has been delivered already still needs to reach
+		// the end of the network, where it is finished
+		if !conn.delivered {
+			return
+		}
+	} else if err != nil {
+		// There is no error path in a network, so respond with an error and
+		// let the rest of the network deliver it.
+		conn.err = err
+		handleResult(conn, err)
+	}
 
 	out <- conn
 }
 
+//////////////////////////////////////////////////////////////////////////////
+// Component loop options
+//
+// By default a component loop spawns a goroutine for every connection it
+// receives, so a burst of traffic creates a goroutine per connection for every
+// component in the network. Wrapping a component with WithLoopOptions before
+// it is given to ProcNetwork instead runs it on a fixed pool of workers, fed
+// by a bounded queue, with a policy for what happens when the queue is full.
+
+// What a component loop does with a connection when its queue is full
+type OverloadPolicy int
+
+const (
+	// Wait for room in the queue, holding up the components before this one
+	OverloadBlock OverloadPolicy = iota
+	// Respond with a 503 and pass the connection on without handling it
+	OverloadShed
+	// Wait for up to QueueTimeout for room in the queue, then shed
+	OverloadQueue
+)
+
+// A connection that is shed is answered with a 503 straight away, through
+// OutputPipe, and then passes through the rest of the network without being
+// handled by any other component.
+type LoopOptions struct {
+	Workers      int            // the number of workers, or 0 for one per connection
+	Buffer       int            // the number of connections that can wait once every worker is busy
+	Overload     OverloadPolicy // what to do when the queue is full
+	QueueTimeout time.Duration  // how long OverloadQueue waits
+}
+
+type loopComponent struct {
+	component Component
+	opts      LoopOptions
+}
+
+// Return 'comp' configured to run with 'opts' when it is part of a network.
+// The options have no effect when the component is used in a Chain.
+func WithLoopOptions(comp Component, opts LoopOptions) Component {
+	return &loopComponent{comp, opts}
+}
+
+func (lc *loopComponent) HandleConn(c *Conn, req *http.Request) error {
+	return HandlerFor(lc.component).HandleConn(c, req)
+}
+
+func (lc *loopComponent) HandleHTTPRequest(c *Conn, req *http.Request) bool {
+	return lc.component.HandleHTTPRequest(c, req)
+}
+
+func (lc *loopComponent) String() string {
+	return componentName(lc.component)
+}
+
+func loopOptions(comp Component) LoopOptions {
+	if lc, ok := comp.(*loopComponent); ok {
+		return lc.opts
+	}
+	return LoopOptions{}
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // Component network adapter
 //
@@ -90,42 +437,78 @@ func componentHandle(component Component, conn *Conn, out chan *Conn) {
 // adapter then waits for the same connection to exit the network (via the out
 // channel), which lets the ServeHTTP call return.
 //
+// Once the network has been shut down, requests are answered with a 503.
+//
 // This is experimental
 
 type _NetworkHandler struct {
-	in   chan *Conn          // the input channel for the entire network
-	out  chan *Conn          // the output channel for the entire network
-	done map[*Conn]chan bool // a map for tracking non-finished connections
+	*Network // the network that requests are injected into
+
+	pages *ErrorPages // the error pages for connections in this network
 }
 
 // Take in an input and an output channel and return an object that fulfills
 // the http.Handler interface
 func NetworkHandler(components ...Component) *_NetworkHandler {
-	in, out := ProcNetwork(components...)
-	return NetworkHandlerInOut(in, out)
+	return NetworkHandlerFor(ProcNetwork(components...))
 }
 
-func NetworkHandlerInOut(in, out chan *Conn) *_NetworkHandler {
-	nh := &_NetworkHandler{in, out, make(map[*Conn]chan bool)}
+// Serve requests using channels that are connected to networks built
+// elsewhere. Shutting the handler down stops it accepting requests and waits
+// for the in-flight ones, and then shuts down each of 'networks', which
+// should be every network that requests pass through. A network that is not
+// given is left running, and the caller must shut it down.
+func NetworkHandlerInOut(in, out chan *Conn, networks ...*Network) *_NetworkHandler {
+	return NetworkHandlerFor(&Network{In: in, Out: out, quit: make(chan struct{}), linked: networks})
+}
+
+// Serve requests using the network 'n'
+func NetworkHandlerFor(n *Network) *_NetworkHandler {
+	nh := &_NetworkHandler{Network: n}
 	go nh.Sink()
 	return nh
 }
 
+// Render canned status responses for this network using 'pages'
+func (nh *_NetworkHandler) WithErrorPages(pages *ErrorPages) *_NetworkHandler {
+	nh.pages = pages
+	return nh
+}
+
 func (nh *_NetworkHandler) Sink() {
-	for conn := range nh.out {
-		nh.done[conn] <- true
+	for {
+		select {
+		case conn, ok := <-nh.Out:
+			if !ok {
+				return
+			}
+			conn.finish()
+		case <-nh.quit:
+			return
+		}
 	}
 }
 
 func (nh *_NetworkHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	conn := NewConn(w, req)
+	conn.pages = nh.pages
+	defer conn.cancel()
+
+	if !nh.enter() {
+		conn.HTTPStatusResponse(http.StatusServiceUnavailable)
+		OutputPipe(conn, req)
+		return
+	}
+	defer nh.Done()
 
-	nh.done[conn] = make(chan bool)
+	// The connection carries its own completion channel, which the sink
+	// closes when the connection comes out of the network. This keeps the
+	// handler free of any state shared between requests.
+	conn.finished = make(chan struct{})
 
 	// Send the connection into the network
-	nh.in <- conn
+	nh.In <- conn
 
 	// Wait for a response
-	<-nh.done[conn]
-	delete(nh.done, conn)
+	<-conn.finished
 }
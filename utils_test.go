@@ -0,0 +1,191 @@
+package webpipes
+
+import "context"
+import "io"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "sync"
+import "testing"
+import "time"
+
+// Send 'n' requests for 'path' to 'handler' at once, checking each response
+func stressHandler(t *testing.T, handler http.Handler, path string, n int, check func(*httptest.ResponseRecorder) bool) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			if !check(rec) {
+				mu.Lock()
+				if failures == 0 {
+					t.Errorf("GET %s: status %d, %d bytes", path, rec.Code, rec.Body.Len())
+				}
+				failures++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if failures > 0 {
+		t.Errorf("%d of %d requests failed", failures, n)
+	}
+}
+
+func TestNetworkHandlerStressSource(t *testing.T) {
+	handler := NetworkHandler(TextStringSource("Hello, world"), OutputPipe)
+	defer handler.Shutdown(context.Background())
+
+	stressHandler(t, handler, "/", 2000, func(rec *httptest.ResponseRecorder) bool {
+		return rec.Code == http.StatusOK && rec.Body.String() == "Hello, world"
+	})
+}
+
+func TestNetworkHandlerStressFileServer(t *testing.T) {
+	want, err := os.ReadFile("http-data/ipsum.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NetworkHandler(FileServer("http-data", "/"), OutputPipe)
+	defer handler.Shutdown(context.Background())
+
+	stressHandler(t, handler, "/ipsum.txt", 2000, func(rec *httptest.ResponseRecorder) bool {
+		return rec.Code == http.StatusOK && rec.Body.String() == string(want)
+	})
+}
+
+func TestNetworkHandlerStressServer(t *testing.T) {
+	srv := httptest.NewServer(NetworkHandler(TextStringSource("Hello, world"), OutputPipe))
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "Hello, world" {
+				t.Errorf("status %d, body %q", resp.StatusCode, body)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Serve three requests at once with a network whose first component has one
+// worker and is held up until the others have been dispatched
+func overloadStatuses(t *testing.T, opts LoopOptions) map[int]int {
+	started := make(chan bool, 3)
+	release := make(chan bool)
+	var slow Pipe = func(conn *Conn, req *http.Request) bool {
+		started <- true
+		<-release
+		return true
+	}
+	handler := NetworkHandler(WithLoopOptions(slow, opts), TextStringSource("hi"), OutputPipe)
+	defer handler.Shutdown(context.Background())
+
+	statuses := make(map[int]int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	serve := func() {
+		defer wg.Done()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		mu.Lock()
+		statuses[rec.Code]++
+		mu.Unlock()
+	}
+
+	wg.Add(1)
+	go serve()
+	<-started
+	wg.Add(2)
+	go serve()
+	go serve()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return statuses
+}
+
+func TestLoopOptionsShed(t *testing.T) {
+	statuses := overloadStatuses(t, LoopOptions{Workers: 1, Overload: OverloadShed})
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusServiceUnavailable] != 2 {
+		t.Errorf("statuses %v, want one 200 and two 503s", statuses)
+	}
+}
+
+func TestLoopOptionsQueue(t *testing.T) {
+	statuses := overloadStatuses(t, LoopOptions{Workers: 1, Buffer: 1, Overload: OverloadQueue, QueueTimeout: 20 * time.Millisecond})
+	if statuses[http.StatusOK] != 2 || statuses[http.StatusServiceUnavailable] != 1 {
+		t.Errorf("statuses %v, want two 200s and one 503", statuses)
+	}
+}
+
+func TestLoopOptionsIdleWorker(t *testing.T) {
+	handler := NetworkHandler(WithLoopOptions(TextStringSource("hi"), LoopOptions{Workers: 1, Overload: OverloadShed}), OutputPipe)
+	defer handler.Shutdown(context.Background())
+
+	// A worker may not yet be waiting for work when the first request arrives
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hi" {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body)
+	}
+}
+
+func TestNetworkHandlerRejected(t *testing.T) {
+	users := map[string]string{"user": "secret"}
+	handler := NetworkHandler(SimpleAuth(users, "test", nil), TextStringSource("Hello, world"), OutputPipe)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("user", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "Hello, world" {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %s", err)
+	}
+}
+
+func TestNetworkHandlerInOutShutdown(t *testing.T) {
+	network := ProcNetwork(TextStringSource("Hello, world"), OutputPipe)
+	handler := NetworkHandlerInOut(network.In, network.Out, network)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "Hello, world" {
+		t.Errorf("body %q", rec.Body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %s", err)
+	}
+	if _, ok := <-network.Out; ok {
+		t.Errorf("network still running after shutdown")
+	}
+}